@@ -1,7 +1,133 @@
 package broker
 
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Default channel expirations
+const (
+	DefaultKeyExpire     = time.Minute // after the channel is closed
+	DefaultChannelExpire = time.Hour   // after the last activity
+)
+
+// known errors
+var (
+	ErrNotRegistered = errors.New("Channel is not registered.")
+	ErrClosed        = errors.New("Channel is closed.")
+	ErrTooLarge      = errors.New("Channel size limit exceeded.")
+	ErrInvalidCursor = errors.New("Invalid listing cursor.")
+	ErrPurged        = errors.New("Channel was purged.")
+	ErrExists        = errors.New("Channel already exists.")
+	ErrLeased        = errors.New("Channel is leased to another publisher.")
+)
+
+// TruncatedMarker is appended to channels exceeding their size
+// limit, right before they get closed.
+const TruncatedMarker = "\n[Output truncated: the stream exceeded its size limit]\n"
+
+// ChannelOptions holds the settings of a channel given when
+// it's registered. Zero values stand for the broker defaults.
+type ChannelOptions struct {
+	ChannelExpire time.Duration // after the last activity
+	KeyExpire     time.Duration // after the channel is closed
+	MaxSize       int64         // in bytes
+	Creator       string        // who registered the channel
+	ContentType   string        // of the channel content
+	Reset         bool          // wipes the channel if it already exists
+	Reopenable    bool          // lets writes reopen the channel once closed
+}
+
+// Metadata describes a registered channel.
+type Metadata struct {
+	Creator     string     `json:"creator,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"` // last write
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	Size        int64      `json:"size"`
+	Closed      bool       `json:"closed"`
+	Truncated   bool       `json:"truncated"`
+	Sealed      bool       `json:"sealed"` // can't be reopened once closed
+	Lines       int64      `json:"lines"`  // newlines written
+
+	// Generation is incremented every time the channel is registered
+	// again, which tells offsets of its previous content apart.
+	Generation int64 `json:"generation"`
+}
+
 // Registrar is a basic broker interface
 type Registrar interface {
 	Register(key string) error
-	IsRegistered(key string) bool
+
+	// RegisterWithOptions registers a channel with its own settings.
+	// ErrExists is returned if it's already registered, unless it's
+	// being reset.
+	RegisterWithOptions(key string, opts *ChannelOptions) error
+	IsRegistered(key string) (bool, error)
+}
+
+// Broker is the interface every channel backend implements.
+// The HTTP layer only talks to a Broker, so backends can be
+// swapped without touching it.
+type Broker interface {
+	Registrar
+
+	// NewReader opens a reader replaying the channel content,
+	// then following it until the channel is closed.
+	NewReader(key string) (io.ReadCloser, error)
+
+	// NewWriter opens a writer appending to the channel.
+	// Closing the writer marks the channel as done.
+	NewWriter(key string) (io.WriteCloser, error)
+
+	// Len returns the length of the data already sent to the channel.
+	Len(key string) (int64, error)
+
+	// Done returns whether the channel has been closed by its publisher.
+	Done(key string) (bool, error)
+
+	// RenewExpiry renews the channel expiration.
+	RenewExpiry(key string) error
+
+	// Meta returns the channel metadata.
+	Meta(key string) (*Metadata, error)
+
+	// List returns the registered channels matching opts, along with
+	// the cursor to list the next ones, empty once all were listed.
+	List(opts *ListOptions) ([]ChannelInfo, string, error)
+
+	// Lease acquires, or renews, the exclusive right to publish to
+	// the channel for ttl, for the publisher identified by token.
+	// ErrLeased is returned while another publisher holds it. An
+	// empty token only checks that nobody does.
+	Lease(key, token string, ttl time.Duration) error
+
+	// ReleaseLease gives up the lease held with token, if any.
+	ReleaseLease(key, token string) error
+
+	// Purge deletes the channel and its data, disconnecting its
+	// readers. It can't be registered again until grace has elapsed.
+	Purge(key string, grace time.Duration) error
+
+	// Index returns the index of the channel content, as archived
+	// along with it.
+	Index(key string) (*Index, error)
+
+	// TimeOffset returns the offset of the channel content written
+	// from t on, as given by its index.
+	TimeOffset(key string, t time.Time) (int64, error)
+
+	// LineOffset returns the offset of the closest line up to line
+	// marked in the channel index, along with its number.
+	LineOffset(key string, line int64) (offset, marked int64, err error)
+
+	// Get returns a snapshot of the whole channel content.
+	Get(key string) ([]byte, error)
+
+	// NewSnapshotReader opens a reader of the channel content as of
+	// now, without following it. Unlike Get, the content doesn't
+	// need to fit in memory.
+	NewSnapshotReader(key string) (io.ReadCloser, error)
 }
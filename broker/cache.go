@@ -0,0 +1,279 @@
+package broker
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/heroku/busl/util"
+)
+
+const (
+	// DefaultCacheSize is the memory used by default to keep
+	// the tail of the channels read by this process.
+	DefaultCacheSize = 32 << 20
+
+	cacheWindow     = 1 << 20 // bytes kept per channel
+	cacheQueue      = 64      // notifications queued per channel
+	cacheSampleRate = 100     // lookups between two hit ratio samples
+)
+
+// fetchFunc reads the data of a channel between start and end,
+// along with its current size and whether it's done.
+type fetchFunc func(c channel, start, end int64) (data []byte, size int64, done bool, err error)
+
+// tailCache keeps the tail of the channels being followed, so the
+// local readers woken up by a notification share a single fetch.
+// Its size is bounded, the least recently read channels being
+// evicted first.
+type tailCache struct {
+	fetch    fetchFunc
+	maxBytes int64
+
+	mutex   *sync.Mutex
+	bytes   int64
+	lru     *list.List // of *cacheEntry, most recent first
+	entries map[channel]*list.Element
+
+	lookups int64
+	hits    int64
+}
+
+// cacheEntry holds the data of a channel from start onwards,
+// as of its last refresh. Data being append only, what it holds
+// stays valid; only the tail needs refreshing after a notification.
+type cacheEntry struct {
+	channel channel
+	mutex   *sync.Mutex
+	start   int64
+	data    []byte
+	size    int64
+	done    bool
+	loaded  bool
+	stale   bool
+
+	queue     []publication // guarded by the cache mutex
+	accounted int64         // bytes accounted in the cache size
+}
+
+// publication is a notification received for a channel. Its data
+// is nil when the notification didn't carry what was appended.
+type publication struct {
+	offset int64
+	data   []byte
+}
+
+func newTailCache(maxBytes int64, fetch fetchFunc) *tailCache {
+	return &tailCache{
+		fetch:    fetch,
+		maxBytes: maxBytes,
+		mutex:    &sync.Mutex{},
+		lru:      list.New(),
+		entries:  make(map[channel]*list.Element),
+	}
+}
+
+// read returns up to length bytes of c from offset.
+func (t *tailCache) read(c channel, offset int64, length int) ([]byte, int64, bool, error) {
+	if t.maxBytes <= 0 {
+		return t.fetch(c, offset, offset+int64(length))
+	}
+
+	e := t.entry(c)
+	e.mutex.Lock()
+	queue := t.dequeue(e)
+
+	end := e.start + int64(len(e.data))
+	if e.loaded && offset < e.start {
+		// Fell behind the window: don't move it backwards
+		// for the sake of a single reader.
+		e.mutex.Unlock()
+		t.count(false)
+		return t.fetch(c, offset, offset+int64(length))
+	}
+	if !e.loaded || offset > end {
+		e.start, e.data, e.loaded = offset, nil, false
+		end = offset
+	}
+	if e.loaded {
+		e.apply(queue, t.window())
+		end = e.start + int64(len(e.data))
+	}
+
+	hit := true
+	if offset+int64(length) > end && (e.stale || !e.loaded || end < e.size) {
+		hit = false
+		if err := e.refresh(t.fetch, t.window()); err != nil {
+			e.mutex.Unlock()
+			return nil, 0, false, err
+		}
+		end = e.start + int64(len(e.data))
+	}
+
+	stop := offset + int64(length)
+	if stop > end {
+		stop = end
+	}
+	data := make([]byte, stop-offset)
+	copy(data, e.data[offset-e.start:stop-e.start])
+	size, done, held := e.size, e.done, int64(len(e.data))
+	e.mutex.Unlock()
+
+	t.resize(e, held)
+	t.count(hit)
+	return data, size, done, nil
+}
+
+// invalidate marks the tail of c as outdated after a notification.
+func (t *tailCache) invalidate(c channel) {
+	t.publish(c, -1, nil)
+}
+
+// publish queues a notification of data appended to c at offset.
+// It's applied by the next read of c, unless the queue is full in
+// which case the next read refreshes the tail instead.
+func (t *tailCache) publish(c channel, offset int64, data []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	el, ok := t.entries[c]
+	if !ok {
+		return
+	}
+
+	e := el.Value.(*cacheEntry)
+	if len(e.queue) >= cacheQueue {
+		e.queue = append(e.queue[:0], publication{offset: -1})
+		return
+	}
+	e.queue = append(e.queue, publication{offset, data})
+}
+
+func (t *tailCache) dequeue(e *cacheEntry) []publication {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queue := e.queue
+	e.queue = nil
+	return queue
+}
+
+// remove drops c once it has no local reader anymore.
+func (t *tailCache) remove(c channel) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if el, ok := t.entries[c]; ok {
+		t.evict(el)
+	}
+}
+
+func (t *tailCache) entry(c channel) *cacheEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if el, ok := t.entries[c]; ok {
+		t.lru.MoveToFront(el)
+		return el.Value.(*cacheEntry)
+	}
+
+	e := &cacheEntry{channel: c, mutex: &sync.Mutex{}}
+	t.entries[c] = t.lru.PushFront(e)
+	return e
+}
+
+func (t *tailCache) window() int64 {
+	if t.maxBytes < cacheWindow {
+		return t.maxBytes
+	}
+	return cacheWindow
+}
+
+// resize accounts for the bytes now held by e, evicting
+// the least recently read channels when over the limit.
+func (t *tailCache) resize(e *cacheEntry, held int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if el, ok := t.entries[e.channel]; !ok || el.Value != e {
+		return // evicted meanwhile
+	}
+
+	t.bytes += held - e.accounted
+	e.accounted = held
+
+	for t.bytes > t.maxBytes && t.lru.Len() > 1 {
+		util.Count("redis.cache.eviction")
+		t.evict(t.lru.Back())
+	}
+}
+
+func (t *tailCache) evict(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	t.lru.Remove(el)
+	delete(t.entries, e.channel)
+	t.bytes -= e.accounted
+}
+
+func (t *tailCache) count(hit bool) {
+	if hit {
+		atomic.AddInt64(&t.hits, 1)
+	}
+	if atomic.AddInt64(&t.lookups, 1)%cacheSampleRate != 0 {
+		return
+	}
+
+	hits := atomic.SwapInt64(&t.hits, 0)
+	util.Sample("redis.cache.hit_ratio", hits*100/cacheSampleRate)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	util.Sample("redis.cache.bytes", t.bytes)
+}
+
+// apply appends the data carried by notifications. The tail is
+// only marked stale, to be fetched, when a notification came without
+// its data or when one was missed, leaving a gap.
+func (e *cacheEntry) apply(queue []publication, window int64) {
+	for _, pub := range queue {
+		end := e.start + int64(len(e.data))
+		if pub.data == nil || pub.offset > end {
+			if pub.data != nil {
+				util.Count("redis.cache.gap")
+			}
+			e.stale = true
+			continue
+		}
+
+		if skip := end - pub.offset; skip < int64(len(pub.data)) {
+			e.append(pub.data[skip:], window)
+		}
+		if size := pub.offset + int64(len(pub.data)); size > e.size {
+			e.size = size
+		}
+		e.done = false
+	}
+}
+
+// refresh fetches what was appended after the data held by e.
+func (e *cacheEntry) refresh(fetch fetchFunc, window int64) error {
+	end := e.start + int64(len(e.data))
+
+	data, size, done, err := fetch(e.channel, end, end+window)
+	if err != nil {
+		return err
+	}
+
+	e.append(data, window)
+	e.size, e.done, e.loaded, e.stale = size, done, true, false
+	return nil
+}
+
+// append adds data to the tail, trimming it to the window size.
+func (e *cacheEntry) append(data []byte, window int64) {
+	e.data = append(e.data, data...)
+	if over := int64(len(e.data)) - window; over > 0 {
+		e.data = append([]byte(nil), e.data[over:]...)
+		e.start += over
+	}
+}
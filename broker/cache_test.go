@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeChannel struct {
+	data    []byte
+	done    bool
+	fetches int
+}
+
+func (f *fakeChannel) fetch(c channel, start, end int64) ([]byte, int64, bool, error) {
+	f.fetches++
+	size := int64(len(f.data))
+	if start > size {
+		start = size
+	}
+	if end > size {
+		end = size
+	}
+	return f.data[start:end], size, f.done, nil
+}
+
+func TestCacheSharesFetches(t *testing.T) {
+	f := &fakeChannel{data: []byte("busl")}
+	cache := newTailCache(DefaultCacheSize, f.fetch)
+
+	for i := 0; i < 10; i++ {
+		data, size, done, err := cache.read("1", 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, "busl", string(data))
+		assert.Equal(t, int64(4), size)
+		assert.False(t, done)
+	}
+	assert.Equal(t, 1, f.fetches)
+
+	f.data = append(f.data, " hello"...)
+	f.done = true
+	cache.invalidate("1")
+
+	for i := 0; i < 10; i++ {
+		data, size, done, err := cache.read("1", 4, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, " hello", string(data))
+		assert.Equal(t, int64(10), size)
+		assert.True(t, done)
+	}
+	assert.Equal(t, 2, f.fetches)
+}
+
+func TestCacheReadBehindWindow(t *testing.T) {
+	f := &fakeChannel{data: []byte("busl hello world")}
+	cache := newTailCache(DefaultCacheSize, f.fetch)
+
+	data, _, _, _ := cache.read("1", 5, 5)
+	assert.Equal(t, "hello", string(data))
+
+	data, _, _, _ = cache.read("1", 0, 4)
+	assert.Equal(t, "busl", string(data))
+	assert.Equal(t, 2, f.fetches)
+
+	// The window wasn't moved backwards
+	data, _, _, _ = cache.read("1", 11, 5)
+	assert.Equal(t, "world", string(data))
+	assert.Equal(t, 2, f.fetches)
+}
+
+func TestCacheEviction(t *testing.T) {
+	f := &fakeChannel{data: []byte("busl")}
+	cache := newTailCache(6, f.fetch)
+
+	cache.read("1", 0, 4)
+	cache.read("2", 0, 4)
+	assert.Equal(t, int64(4), cache.bytes)
+	assert.Equal(t, 1, cache.lru.Len())
+
+	_, ok := cache.entries["1"]
+	assert.False(t, ok)
+}
+
+func TestCacheDisabled(t *testing.T) {
+	f := &fakeChannel{data: []byte("busl")}
+	cache := newTailCache(-1, f.fetch)
+
+	cache.read("1", 0, 4)
+	cache.read("1", 0, 4)
+	assert.Equal(t, 2, f.fetches)
+	assert.Equal(t, 0, cache.lru.Len())
+}
+
+func TestCacheAppliesPublications(t *testing.T) {
+	f := &fakeChannel{data: []byte("busl")}
+	cache := newTailCache(DefaultCacheSize, f.fetch)
+	cache.read("1", 0, 10)
+
+	f.data = append(f.data, " hello"...)
+	cache.publish("1", 4, []byte(" hello"))
+
+	data, size, _, err := cache.read("1", 4, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, " hello", string(data))
+	assert.Equal(t, int64(10), size)
+	assert.Equal(t, 1, f.fetches)
+
+	// A missed publication leaves a gap, filled by a fetch
+	f.data = append(f.data, " world!"...)
+	cache.publish("1", 16, []byte("!"))
+
+	data, size, _, err = cache.read("1", 10, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, " world!", string(data))
+	assert.Equal(t, int64(17), size)
+	assert.Equal(t, 2, f.fetches)
+}
@@ -0,0 +1,202 @@
+package broker
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+const clusterSlots = 16384
+
+// cluster maps keys to the redis cluster node serving their slot.
+// The mapping is loaded from the seed node on first use and reloaded
+// whenever a node answers with a MOVED or ASK redirection.
+type cluster struct {
+	seed string
+	dial func(addr string) (redis.Conn, error)
+
+	mutex  *sync.RWMutex
+	slots  []string // node address by slot
+	stale  bool
+	reload *sync.Mutex
+}
+
+func newCluster(seed string, dial func(string) (redis.Conn, error)) *cluster {
+	return &cluster{
+		seed:   seed,
+		dial:   dial,
+		mutex:  &sync.RWMutex{},
+		stale:  true,
+		reload: &sync.Mutex{},
+	}
+}
+
+// addr returns the address of the node serving key.
+func (c *cluster) addr(key string) string {
+	c.mutex.RLock()
+	stale := c.stale
+	c.mutex.RUnlock()
+
+	if stale {
+		if err := c.refresh(); err != nil {
+			util.CountWithData("redis.cluster.refresh.error", 1, "error=%s", err)
+		}
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.slots == nil || c.slots[hashSlot(key)] == "" {
+		return c.seed
+	}
+	return c.slots[hashSlot(key)]
+}
+
+// masters returns the sorted addresses of the nodes serving slots.
+func (c *cluster) masters() []string {
+	c.addr("") // loads the mapping when stale
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var masters []string
+	for _, addr := range c.slots {
+		if addr != "" && !util.StringInSlice(masters, addr) {
+			masters = append(masters, addr)
+		}
+	}
+	if len(masters) == 0 {
+		return []string{c.seed}
+	}
+	sort.Strings(masters)
+	return masters
+}
+
+func (c *cluster) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stale = true
+}
+
+func (c *cluster) refresh() error {
+	c.reload.Lock()
+	defer c.reload.Unlock()
+
+	c.mutex.RLock()
+	stale := c.stale
+	c.mutex.RUnlock()
+	if !stale {
+		return nil // refreshed concurrently
+	}
+
+	// Any node knows the whole mapping, so fall back
+	// to the known nodes when the seed is unavailable.
+	var slots []string
+	var err error
+	for _, addr := range c.nodes() {
+		if slots, err = c.load(addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots = slots
+	c.stale = false
+	util.Count("redis.cluster.refresh")
+	return nil
+}
+
+func (c *cluster) nodes() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	nodes := []string{c.seed}
+	for _, addr := range c.slots {
+		if addr != "" && !util.StringInSlice(nodes, addr) {
+			nodes = append(nodes, addr)
+		}
+	}
+	return nodes
+}
+
+func (c *cluster) load(addr string) ([]string, error) {
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return parseClusterSlots(conn.Do("CLUSTER", "SLOTS"))
+}
+
+// parseClusterSlots parses a CLUSTER SLOTS reply into the
+// address of the master serving every slot.
+func parseClusterSlots(reply interface{}, err error) ([]string, error) {
+	ranges, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]string, clusterSlots)
+	for _, r := range ranges {
+		info, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(info) < 3 {
+			continue
+		}
+
+		start, _ := redis.Int(info[0], nil)
+		end, _ := redis.Int(info[1], nil)
+		master, err := redis.Values(info[2], nil)
+		if err != nil || len(master) < 2 {
+			continue
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+// hashSlot returns the cluster slot of key. Only the part between
+// the first braces is hashed when present, which is how all the keys
+// of a channel end up on the same slot.
+func hashSlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 implements the CRC16-CCITT (XMODEM) checksum used by
+// redis cluster.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
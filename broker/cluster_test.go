@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashSlot(t *testing.T) {
+	assert.Equal(t, 12182, hashSlot("foo"))
+	assert.Equal(t, 12739, hashSlot("123456789"))
+
+	// Keys sharing a hash tag share a slot
+	assert.Equal(t, hashSlot("{channel}:id"), hashSlot("{channel}:done"))
+	assert.Equal(t, hashSlot("{channel}:id"), hashSlot("{channel}:kill"))
+	assert.Equal(t, hashSlot("channel"), hashSlot("{channel}:id"))
+
+	// Empty hash tags are ignored
+	assert.Equal(t, hashSlot("{}:id"), int(crc16("{}:id")%clusterSlots))
+}
+
+func TestParseClusterSlots(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(5460), []interface{}{[]byte("10.0.0.1"), int64(6379), []byte("id1")}},
+		[]interface{}{int64(5461), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(6380), []byte("id2")}},
+	}
+
+	slots, err := parseClusterSlots(reply, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:6379", slots[0])
+	assert.Equal(t, "10.0.0.1:6379", slots[5460])
+	assert.Equal(t, "10.0.0.2:6380", slots[5461])
+	assert.Equal(t, "10.0.0.2:6380", slots[16383])
+}
+
+func TestClusterChannelKeys(t *testing.T) {
+	b, err := NewRedisBroker(&RedisOptions{
+		URL:     os.Getenv("REDIS_URL"),
+		Cluster: true,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	uuid, _ := util.NewUUID()
+	c := b.channel(uuid)
+	assert.Equal(t, "{"+uuid+"}:id", c.id())
+
+	// Without cluster support, everything is routed to the seed node.
+	assert.Nil(t, b.Register(uuid))
+	w, err := b.NewWriter(uuid)
+	if !assert.Nil(t, err) {
+		return
+	}
+	w.Write([]byte("hello"))
+
+	buf, err := b.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestClusterMovedRetry(t *testing.T) {
+	server, err := url.Parse(os.Getenv("REDIS_URL"))
+	assert.Nil(t, err)
+	// A node whose slots were resharded
+	node := fakeRedis(t, map[string]string{
+		"CLUSTER": "-ERR cluster support disabled\r\n",
+		"SET":     "-MOVED 1234 " + server.Host + "\r\n",
+	})
+	defer node.Close()
+
+	b, err := NewRedisBroker(&RedisOptions{
+		URL:     "redis://" + node.Addr().String(),
+		Cluster: true,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	uuid, _ := util.NewUUID()
+	conn := b.pool.Get(uuid)
+	defer conn.Close()
+
+	_, err = conn.Do("SET", uuid, "hello")
+	assert.Nil(t, err)
+	assert.True(t, b.pool.cluster.stale)
+
+	direct := b.pool.GetNode(server.Host)
+	defer direct.Close()
+	value, err := redis.String(direct.Do("GET", uuid))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", value)
+}
+
+func TestClusterAskRetry(t *testing.T) {
+	target := fakeRedis(t, map[string]string{
+		"ASKING": "+OK\r\n",
+		"GET":    "$5\r\nhello\r\n",
+	})
+	defer target.Close()
+
+	// A node whose slot is being migrated to target
+	node := fakeRedis(t, map[string]string{
+		"CLUSTER": "-ERR cluster support disabled\r\n",
+		"GET":     "-ASK 1234 " + target.Addr().String() + "\r\n",
+	})
+	defer node.Close()
+
+	b, err := NewRedisBroker(&RedisOptions{
+		URL:     "redis://" + node.Addr().String(),
+		Cluster: true,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	conn := b.pool.Get("busl")
+	defer conn.Close()
+
+	value, err := redis.String(conn.Do("GET", "busl"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", value)
+}
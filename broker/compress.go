@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+var errPart = errors.New("invalid channel data part")
+
+// nextSegment returns the first full segment of a compressed
+// channel still stored raw, along with its data. The last segment
+// is returned too when partial is set (ARGV[1]).
+var nextSegment = redis.NewScript(1, luaSegments+`
+local n = compressibleSegment(KEYS[1], ARGV[1] == '1')
+if not n then
+  return nil
+end
+return {n, redis.call('GET', segment(KEYS[1], n))}
+`)
+
+// storeSegment replaces a raw segment with its compressed data,
+// unless another writer compressed it meanwhile or appended to it,
+// having reopened the channel, as its raw size (ARGV[4]) tells.
+var storeSegment = redis.NewScript(1, luaSegments+`
+if compressibleSegment(KEYS[1], ARGV[3] == '1') ~= tonumber(ARGV[1]) then
+  return 0
+end
+local key = segment(KEYS[1], ARGV[1])
+if redis.call('STRLEN', key) ~= tonumber(ARGV[4]) then
+  return 0
+end
+local ttl = redis.call('TTL', key)
+redis.call('SET', key, ARGV[2])
+if ttl > 0 then
+  redis.call('EXPIRE', key, ttl)
+end
+redis.call('HINCRBY', KEYS[1], 'compressed', 1)
+return 1
+`)
+
+// tailSegment returns the last segment of a channel compressed
+// when it got closed, along with its data.
+var tailSegment = redis.NewScript(1, luaSegments+`
+if not compressedTail(KEYS[1]) then
+  return nil
+end
+local n = tonumber(redis.call('HGET', KEYS[1], 'compressed')) - 1
+return {n, redis.call('GET', segment(KEYS[1], n))}
+`)
+
+// restoreSegment replaces the compressed last segment of a channel
+// with its raw data, unless another writer restored it meanwhile.
+var restoreSegment = redis.NewScript(1, luaSegments+`
+if not compressedTail(KEYS[1]) or tonumber(redis.call('HGET', KEYS[1], 'compressed')) ~= ARGV[1] + 1 then
+  return 0
+end
+local key = segment(KEYS[1], ARGV[1])
+local ttl = redis.call('TTL', key)
+redis.call('SET', key, ARGV[2])
+if ttl > 0 then
+  redis.call('EXPIRE', key, ttl)
+end
+redis.call('HSET', KEYS[1], 'compressed', ARGV[1])
+return 1
+`)
+
+// compressSegments compresses the segments of the channel which
+// filled up, and the last one too when partial is set, reporting
+// their compression ratio: the size they take, in percent of their
+// raw size.
+func (b *RedisBroker) compressSegments(c channel, partial bool) {
+	conn := b.pool.Get(c.id())
+	defer conn.Close()
+
+	for {
+		reply, err := redis.Values(nextSegment.Do(conn, c.id(), partial))
+		if err == redis.ErrNil {
+			return
+		}
+		if err != nil {
+			util.CountWithData("RedisBroker.compress.error", 1, "error=%s", err)
+			return
+		}
+
+		var n int
+		var raw []byte
+		if _, err := redis.Scan(reply, &n, &raw); err != nil {
+			util.CountWithData("RedisBroker.compress.error", 1, "error=%s", err)
+			return
+		}
+
+		data, err := compress(raw)
+		if err != nil {
+			util.CountWithData("RedisBroker.compress.error", 1, "error=%s", err)
+			return
+		}
+		if stored, err := redis.Bool(storeSegment.Do(conn, c.id(), n, data, partial, len(raw))); err != nil || !stored {
+			return
+		}
+
+		util.CountMany("RedisBroker.compress.raw_bytes", int64(len(raw)))
+		util.CountMany("RedisBroker.compress.stored_bytes", int64(len(data)))
+		util.SampleWithData("RedisBroker.compress.ratio", int64(100*len(data)/len(raw)), "channel=%s", c)
+	}
+}
+
+// restoreTail stores back raw the last segment of a reopened
+// channel, which was compressed when it got closed.
+func (b *RedisBroker) restoreTail(conn redis.Conn, c channel) error {
+	reply, err := redis.Values(tailSegment.Do(conn, c.id()))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var n int
+	var compressed []byte
+	if _, err := redis.Scan(reply, &n, &compressed); err != nil {
+		return err
+	}
+	raw, err := inflate(compressed)
+	if err != nil {
+		return err
+	}
+
+	util.Count("RedisBroker.compress.restore")
+	_, err = restoreSegment.Do(conn, c.id(), n, raw)
+	return err
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// joinParts joins the parts of channel data returned by getRange,
+// inflating the compressed segments to slice them.
+func joinParts(reply interface{}) ([]byte, error) {
+	parts, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for _, part := range parts {
+		switch p := part.(type) {
+		case []byte:
+			data = append(data, p...)
+		case []interface{}:
+			var compressed []byte
+			var offset, length int
+			if _, err := redis.Scan(p, &compressed, &offset, &length); err != nil {
+				return nil, err
+			}
+			segment, err := inflate(compressed)
+			if err != nil {
+				return nil, err
+			}
+			if offset+length > len(segment) {
+				return nil, errPart
+			}
+			data = append(data, segment[offset:offset+length]...)
+		default:
+			return nil, errPart
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var compressedBroker, _ = NewRedisBroker(&RedisOptions{
+	URL:         os.Getenv("REDIS_URL"),
+	Layout:      SegmentLayout,
+	SegmentSize: 512,
+	Compress:    true,
+})
+
+func TestCompressedSegments(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	compressedBroker.RegisterWithOptions(uuid, &ChannelOptions{Reopenable: true})
+
+	line := []byte("busl hello world\n")
+	w, _ := compressedBroker.NewWriter(uuid)
+	for i := 0; i < 100; i++ {
+		w.Write(line)
+	}
+	expected := bytes.Repeat(line, 100)
+
+	// Offsets are those of the raw data
+	l, err := compressedBroker.Len(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1700), l)
+
+	data, size, _, err := compressedBroker.getRange(channel(uuid), 500, 1600)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[500:1600], data)
+	assert.Equal(t, int64(1700), size)
+
+	r, _ := compressedBroker.NewReader(uuid)
+	r.(*reader).Seek(1000, 0)
+	w.Close()
+
+	conn := compressedBroker.pool.Get(uuid)
+	defer conn.Close()
+
+	// Once closed, the last segment is stored compressed too
+	assert.Equal(t, 4, waitCompressed(conn, uuid, 4))
+
+	stored, _ := redis.Bytes(conn.Do("GET", uuid+":segment:0"))
+	assert.True(t, len(stored) < 512/4)
+	raw, err := inflate(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[:512], raw)
+
+	stored, _ = redis.Bytes(conn.Do("GET", uuid+":segment:3"))
+	raw, err = inflate(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[1536:], raw)
+
+	data, err = compressedBroker.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, data)
+
+	data, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[1000:], data)
+
+	// Reopening the channel stores its last segment back raw
+	w, _ = compressedBroker.NewWriter(uuid)
+	n, err := w.Write(line)
+	assert.Nil(t, err)
+	assert.Equal(t, len(line), n)
+	expected = append(expected, line...)
+
+	compressed, err := redis.Int(conn.Do("HGET", uuid+":id", "compressed"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, compressed)
+
+	last, _ := redis.Bytes(conn.Do("GET", uuid+":segment:3"))
+	assert.Equal(t, expected[1536:], last)
+
+	data, err = compressedBroker.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, data)
+}
+
+func TestCompressedLogMemory(t *testing.T) {
+	b, err := NewRedisBroker(&RedisOptions{
+		URL:      os.Getenv("REDIS_URL"),
+		Compress: true,
+	})
+	assert.Nil(t, err)
+
+	uuid, _ := util.NewUUID()
+	b.Register(uuid)
+
+	// A typical build log, far below the segment size
+	var log bytes.Buffer
+	for i := 0; log.Len() < 200<<10; i++ {
+		fmt.Fprintf(&log, "-----> Installing dependency %d of %d (%d ms)\n", i%97, 97, i*7%1000)
+		fmt.Fprintf(&log, "       Downloading https://registry.example.com/packages/pkg-%d.tgz\n", i)
+	}
+	w, _ := b.NewWriter(uuid)
+	w.Write(log.Bytes())
+	w.Close()
+
+	conn := b.pool.Get(uuid)
+	defer conn.Close()
+	waitCompressed(conn, uuid, 1)
+
+	stored, err := redis.Int(conn.Do("STRLEN", uuid+":segment:0"))
+	assert.Nil(t, err)
+	assert.True(t, stored < log.Len()/4, "stored %d bytes out of %d", stored, log.Len())
+
+	data, err := b.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, log.Bytes(), data)
+}
+
+// waitCompressed waits for the segments of the channel to be
+// compressed in the background, returning how many were.
+func waitCompressed(conn redis.Conn, uuid string, n int) int {
+	var compressed int
+	for i := 0; i < 100 && compressed < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+		compressed, _ = redis.Int(conn.Do("HGET", uuid+":id", "compressed"))
+	}
+	return compressed
+}
+
+func TestUncompressedChannels(t *testing.T) {
+	uuid := setupSegments()
+
+	w, _ := segmentBroker.NewWriter(uuid)
+	w.Write([]byte("busl hello world"))
+
+	conn := segmentBroker.pool.Get(uuid)
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("HEXISTS", uuid+":id", "compressed"))
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	first, _ := redis.String(conn.Do("GET", uuid+":segment:0"))
+	assert.Equal(t, "busl", first)
+}
@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// hub multiplexes the pub/sub notifications of every reader in the
+// process over a single redis connection. It holds one PSUBSCRIBE
+// per channel being read, and dispatches its notifications to all
+// the local readers of that channel.
+type hub struct {
+	pool  *pool
+	cache *tailCache
+	mutex *sync.Mutex
+	psc   *redis.PubSubConn // nil until the first subscription
+
+	subs    map[string]map[*subscription]bool // by channel pattern
+	pending map[string]chan struct{}          // closed once subscribed
+}
+
+// subscription is a reader's registration with the hub.
+// Notifications are coalesced: a reader that hasn't consumed
+// the previous one only gets a single wake up.
+type subscription struct {
+	channel channel
+	notify  chan struct{}
+	killed  int32         // set once the channel has been killed
+	gone    chan struct{} // closed when the hub connection is lost
+	err     error         // why the hub connection was lost
+}
+
+func newHub(p *pool, cache *tailCache) *hub {
+	return &hub{
+		pool:    p,
+		cache:   cache,
+		mutex:   &sync.Mutex{},
+		subs:    make(map[string]map[*subscription]bool),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// subscribe registers a new subscription to channel, and returns
+// once redis has confirmed it so no notification can be missed.
+func (h *hub) subscribe(channel channel) (*subscription, error) {
+	sub := &subscription{
+		channel: channel,
+		notify:  make(chan struct{}, 1),
+		gone:    make(chan struct{}),
+	}
+	pattern := channel.wildcardID()
+
+	h.mutex.Lock()
+	if h.psc == nil {
+		h.psc = &redis.PubSubConn{Conn: h.pool.GetBlocking("")}
+		go h.receive(h.psc)
+	}
+
+	subs, ok := h.subs[pattern]
+	if !ok {
+		subs = make(map[*subscription]bool)
+		h.subs[pattern] = subs
+	}
+	subs[sub] = true
+	util.Sample("redis.hub.channels", int64(len(h.subs)))
+
+	confirmed, ok := h.pending[pattern]
+	if !ok && len(subs) == 1 {
+		confirmed = make(chan struct{})
+		h.pending[pattern] = confirmed
+		if err := h.psc.PSubscribe(pattern); err != nil {
+			delete(h.pending, pattern)
+			delete(subs, sub)
+			h.mutex.Unlock()
+			return nil, err
+		}
+	}
+	h.mutex.Unlock()
+
+	if confirmed != nil {
+		select {
+		case <-confirmed:
+		case <-sub.gone:
+			return nil, sub.err
+		}
+	}
+
+	// Readers get a first wake up once subscribed, the way
+	// a dedicated connection yields the subscription reply.
+	sub.notify <- struct{}{}
+	return sub, nil
+}
+
+func (h *hub) unsubscribe(sub *subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	pattern := sub.channel.wildcardID()
+	subs, ok := h.subs[pattern]
+	if !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, pattern)
+		h.cache.remove(sub.channel)
+		if h.psc != nil {
+			h.psc.PUnsubscribe(pattern)
+		}
+	}
+}
+
+func (h *hub) receive(psc *redis.PubSubConn) {
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.PMessage:
+			h.dispatch(msg)
+		case redis.Subscription:
+			h.confirm(msg)
+		case error:
+			util.CountWithData("RedisBroker.redisSubscribe.ReceiveError", 1, "err=%s", msg)
+			h.reset(psc, msg)
+			return
+		}
+	}
+}
+
+func (h *hub) dispatch(msg redis.PMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// The cached tail is outdated before anyone is woken up.
+	c := channel(strings.TrimSuffix(msg.Pattern, ":*"))
+	if msg.Channel == c.id() {
+		if offset, data, ok := parsePublication(msg.Data); ok {
+			h.cache.publish(c, offset, data)
+		} else {
+			h.cache.invalidate(c)
+		}
+	} else if msg.Channel == c.killID() && (string(msg.Data) == purgedPayload || string(msg.Data) == resetPayload) {
+		h.cache.remove(c)
+	} else if msg.Channel == c.killID() {
+		h.cache.invalidate(c)
+	}
+
+	for sub := range h.subs[msg.Pattern] {
+		if msg.Channel == sub.channel.killID() {
+			atomic.StoreInt32(&sub.killed, 1)
+		} else if msg.Channel != sub.channel.id() {
+			continue
+		}
+
+		select {
+		case sub.notify <- struct{}{}:
+		default: // a notification is already pending
+		}
+	}
+}
+
+// parsePublication reads the offset and data carried by
+// a notification, when published as "offset:data".
+func parsePublication(payload []byte) (int64, []byte, bool) {
+	i := bytes.IndexByte(payload, ':')
+	if i < 0 {
+		return 0, nil, false
+	}
+
+	offset, err := strconv.ParseInt(string(payload[:i]), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, nil, false
+	}
+	return offset, payload[i+1:], true
+}
+
+func (h *hub) confirm(msg redis.Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if confirmed, ok := h.pending[msg.Channel]; ok && msg.Kind == "psubscribe" {
+		close(confirmed)
+		delete(h.pending, msg.Channel)
+	}
+}
+
+// reset drops every subscription after the connection is lost.
+// The next subscription dials a new connection.
+func (h *hub) reset(psc *redis.PubSubConn, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	psc.Close()
+	if h.psc == psc {
+		h.psc = nil
+	}
+
+	for _, subs := range h.subs {
+		for sub := range subs {
+			sub.err = err
+			close(sub.gone)
+		}
+	}
+	h.subs = make(map[string]map[*subscription]bool)
+	h.pending = make(map[string]chan struct{})
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHubSharesConnection(t *testing.T) {
+	uuid := setup()
+
+	var readers []*reader
+	for i := 0; i < 10; i++ {
+		r, err := redisBroker.NewReader(uuid)
+		assert.Nil(t, err)
+		readers = append(readers, r.(*reader))
+	}
+
+	redisBroker.hub.mutex.Lock()
+	psc := redisBroker.hub.psc
+	assert.Len(t, redisBroker.hub.subs[channel(uuid).wildcardID()], 10)
+	redisBroker.hub.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	outputs := make([][]byte, len(readers))
+	for i, r := range readers {
+		wg.Add(1)
+		go func(i int, r *reader) {
+			defer wg.Done()
+			outputs[i], _ = ioutil.ReadAll(r)
+			r.Close()
+		}(i, r)
+	}
+
+	w, _ := redisBroker.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Close()
+	wg.Wait()
+
+	for _, output := range outputs {
+		assert.Equal(t, "busl hello", string(output))
+	}
+
+	redisBroker.hub.mutex.Lock()
+	defer redisBroker.hub.mutex.Unlock()
+	assert.True(t, psc == redisBroker.hub.psc)
+	_, subscribed := redisBroker.hub.subs[channel(uuid).wildcardID()]
+	assert.False(t, subscribed)
+}
+
+func TestParsePublication(t *testing.T) {
+	offset, data, ok := parsePublication([]byte("12:busl:hello"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(12), offset)
+	assert.Equal(t, "busl:hello", string(data))
+
+	_, data, ok = parsePublication([]byte("0:"))
+	assert.True(t, ok)
+	assert.NotNil(t, data)
+
+	for _, payload := range []string{"1", "busl:hello", "-1:busl"} {
+		_, _, ok = parsePublication([]byte(payload))
+		assert.False(t, ok, payload)
+	}
+}
+
+func TestPublishedData(t *testing.T) {
+	b, _ := NewRedisBroker(&RedisOptions{URL: os.Getenv("REDIS_URL"), PublishLimit: 4})
+	uuid, _ := util.NewUUID()
+	b.Register(uuid)
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	done := make(chan []byte)
+	go func() {
+		output, _ := ioutil.ReadAll(r)
+		done <- output
+	}()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	assert.Equal(t, "busl hello world", string(<-done))
+}
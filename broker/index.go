@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// TimeResolution is the interval at which writes are indexed by time.
+	TimeResolution = time.Second
+
+	// LineInterval is the number of lines between two line marks.
+	LineInterval = 1000
+)
+
+// Index maps points of a channel content to their offset, so readers
+// can start from them. It's recorded as the content is written, and
+// archived along with it.
+type Index struct {
+	Size      int64      `json:"size"`
+	LineCount int64      `json:"line_count"` // newlines written
+	Times     []TimeMark `json:"times"`
+	Lines     []LineMark `json:"lines"`
+}
+
+// TimeMark records the offset of a write made when TimeResolution
+// had elapsed since the previous mark.
+type TimeMark struct {
+	Time   time.Time `json:"time"`
+	Offset int64     `json:"offset"`
+}
+
+// LineMark records the offset every LineInterval-th line starts at.
+// Lines are numbered from 1.
+type LineMark struct {
+	Line   int64 `json:"line"`
+	Offset int64 `json:"offset"`
+}
+
+// TimeOffset returns the offset of the content written from t on.
+// It includes what was written up to TimeResolution before t.
+func (i *Index) TimeOffset(t time.Time) int64 {
+	n := sort.Search(len(i.Times), func(n int) bool {
+		return i.Times[n].Time.After(t)
+	})
+
+	switch {
+	case n == 0:
+		return 0
+	case t.Sub(i.Times[n-1].Time) < TimeResolution:
+		return i.Times[n-1].Offset
+	case n < len(i.Times):
+		return i.Times[n].Offset
+	}
+	return i.Size
+}
+
+// LineOffset returns the offset of the closest marked line up to
+// line, along with its number. Readers skip the lines in between.
+func (i *Index) LineOffset(line int64) (offset, marked int64) {
+	n := sort.Search(len(i.Lines), func(n int) bool {
+		return i.Lines[n].Line > line
+	})
+	if n == 0 {
+		return 0, 1
+	}
+	return i.Lines[n-1].Offset, i.Lines[n-1].Line
+}
+
+// With every layout, the time index of a channel is a sorted set of
+// the offsets of its writes, scored by their time in milliseconds.
+// A write is indexed if TimeResolution, in milliseconds, has elapsed
+// since the last one.
+//
+// The line index is a sorted set of the offsets every LineInterval-th
+// line starts at, scored by line number. The lines field of the meta
+// hash counts the newlines written so far.
+const luaIndex = `
+local function times(index)
+  return string.sub(index, 1, -4) .. ':times'
+end
+
+local function lines(index)
+  return string.sub(index, 1, -4) .. ':lines'
+end
+
+local function entries(index)
+  return string.sub(index, 1, -4) .. ':entries'
+end
+
+local function markTime(index, offset, now)
+  local last = redis.call('ZREVRANGE', times(index), 0, 0, 'WITHSCORES')
+  if not last[2] or tonumber(now) - tonumber(last[2]) >= 1000 then
+    redis.call('ZADD', times(index), now, offset)
+  end
+end
+
+local function markLines(index, meta, offset, data)
+  local _, n = string.gsub(data, '\n', '')
+  if n == 0 then
+    return
+  end
+  local count = tonumber(redis.call('HGET', meta, 'lines')) or 0
+  local pos, seen = 0, count
+  local mark = count - count % 1000 + 1000
+  while mark <= count + n do
+    while seen < mark do
+      pos = string.find(data, '\n', pos + 1, true)
+      seen = seen + 1
+    end
+    redis.call('ZADD', lines(index), mark + 1, offset + pos)
+    mark = mark + 1000
+  end
+  redis.call('HINCRBY', meta, 'lines', n)
+end
+
+local function expireIndex(index, ttl)
+  redis.call('EXPIRE', times(index), ttl)
+  redis.call('EXPIRE', lines(index), ttl)
+  redis.call('EXPIRE', entries(index), ttl)
+end
+
+local function deleteIndex(index)
+  redis.call('DEL', times(index), lines(index), entries(index))
+end
+`
+
+// Index returns the whole index of the channel.
+func (b *RedisBroker) Index(key string) (*Index, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	times, err := parseTimeMarks(conn.Do("ZRANGE", channel.timesID(), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	lines, err := parseLineMarks(conn.Do("ZRANGE", channel.linesID(), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	count, err := redis.Int64(conn.Do("HGET", channel.metaID(), metaLines))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	size, err := b.Len(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{Size: size, LineCount: count, Times: times, Lines: lines}, nil
+}
+
+// TimeOffset returns the offset of the channel content written from
+// t on, only looking up the marks around t.
+func (b *RedisBroker) TimeOffset(key string, t time.Time) (int64, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	at := millis(t)
+	before, err := parseTimeMarks(conn.Do("ZREVRANGEBYSCORE", channel.timesID(), at, "-inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return 0, err
+	}
+	after, err := parseTimeMarks(conn.Do("ZRANGEBYSCORE", channel.timesID(), "("+strconv.FormatInt(at, 10), "+inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return 0, err
+	}
+	size, err := b.Len(key)
+	if err != nil {
+		return 0, err
+	}
+
+	index := &Index{Size: size, Times: append(before, after...)}
+	return index.TimeOffset(t), nil
+}
+
+// LineOffset returns the offset of the closest marked line up to
+// line, along with its number, only looking up that mark.
+func (b *RedisBroker) LineOffset(key string, line int64) (offset, marked int64, err error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	lines, err := parseLineMarks(conn.Do("ZREVRANGEBYSCORE", channel.linesID(), line, "-inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset, marked = (&Index{Lines: lines}).LineOffset(line)
+	return offset, marked, nil
+}
+
+// parseTimeMarks parses a sorted set of offsets scored by time.
+func parseTimeMarks(reply interface{}, err error) ([]TimeMark, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	marks := make([]TimeMark, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		offset, err := strconv.ParseInt(values[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ms, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		marks = append(marks, TimeMark{time.Unix(0, int64(ms)*int64(time.Millisecond)), offset})
+	}
+	return marks, nil
+}
+
+// parseLineMarks parses a sorted set of offsets scored by line.
+func parseLineMarks(reply interface{}, err error) ([]LineMark, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	marks := make([]LineMark, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		offset, err := strconv.ParseInt(values[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		line, err := strconv.ParseInt(values[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		marks = append(marks, LineMark{line, offset})
+	}
+	return marks, nil
+}
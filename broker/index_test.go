@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeOffset(t *testing.T) {
+	start := time.Date(2016, 1, 1, 14, 0, 0, 0, time.UTC)
+	index := &Index{
+		Size: 300,
+		Times: []TimeMark{
+			{start, 0},
+			{start.Add(2 * time.Second), 100},
+			{start.Add(time.Minute), 200},
+		},
+	}
+
+	for at, offset := range map[time.Duration]int64{
+		-time.Hour:                0,
+		0:                         0,
+		500 * time.Millisecond:    0,
+		time.Second:               100,
+		2 * time.Second:           100,
+		30 * time.Second:          200,
+		time.Minute + time.Second: 300,
+	} {
+		assert.Equal(t, offset, index.TimeOffset(start.Add(at)), at.String())
+	}
+
+	assert.Equal(t, int64(0), (&Index{}).TimeOffset(start))
+}
+
+func TestLineOffset(t *testing.T) {
+	index := &Index{
+		Lines: []LineMark{{1001, 2000}, {2001, 4000}},
+	}
+
+	for line, expected := range map[int64][2]int64{
+		1:    {0, 1},
+		1000: {0, 1},
+		1001: {2000, 1001},
+		1500: {2000, 1001},
+		9000: {4000, 2001},
+	} {
+		offset, marked := index.LineOffset(line)
+		assert.Equal(t, expected, [2]int64{offset, marked}, "line %d", line)
+	}
+}
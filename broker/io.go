@@ -4,92 +4,191 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/heroku/busl/util"
 )
 
 type writer struct {
-	channel channel
+	broker      *RedisBroker
+	channel     channel
+	compressing int32 // set while segments are compressed
+	closing     int32 // set once closed, until the last segment is compressed
 }
 
-// known errors
-var (
-	ErrNotRegistered = errors.New("Channel is not registered.")
-	ErrClosed        = errors.New("Channel is closed.")
-)
-
-// NewWriter creates a new redis channel writer
-func NewWriter(key string) (io.WriteCloser, error) {
-	r, err := NewRedisRegistrar().IsRegistered(key)
-	if err != nil {
-		return nil, err
-	}
+func (w *writer) Close() error {
+	conn := w.broker.pool.Get(w.channel.id())
+	defer conn.Close()
 
-	if !r {
-		return nil, ErrNotRegistered
+	conn.Send("MULTI")
+	conn.Send("SET", w.channel.doneID(), []byte{1})
+	conn.Send("HSET", w.channel.metaID(), metaClosedAt, millis(time.Now()))
+	w.broker.sendCloseExpiry(conn, w.channel)
+	conn.Send("PUBLISH", w.channel.killID(), 1)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
 	}
 
-	return &writer{channel(key)}, nil
+	atomic.StoreInt32(&w.closing, 1)
+	w.compress()
+	return nil
 }
 
-func (w *writer) Close() error {
-	conn := redisPool.Get()
-	defer conn.Close()
+// compress compresses the segments of the channel in the background,
+// sparing the publisher the wait, the last one too once closed. A
+// single compression runs at a time, catching up with a close that
+// happened meanwhile.
+func (w *writer) compress() {
+	if !atomic.CompareAndSwapInt32(&w.compressing, 0, 1) {
+		return
+	}
 
-	conn.Send("MULTI")
-	conn.Send("EXPIRE", w.channel.id(), redisKeyExpire)
-	conn.Send("SETEX", w.channel.doneID(), redisChannelExpire, []byte{1})
-	conn.Send("PUBLISH", w.channel.killID(), 1)
-	_, err := conn.Do("EXEC")
-	return err
+	go func() {
+		for {
+			partial := atomic.SwapInt32(&w.closing, 0) == 1
+			w.broker.compressSegments(w.channel, partial)
+			atomic.StoreInt32(&w.compressing, 0)
+
+			if atomic.LoadInt32(&w.closing) == 0 || !atomic.CompareAndSwapInt32(&w.compressing, 0, 1) {
+				return
+			}
+		}
+	}()
 }
 
+// appendChannel appends to a channel and reopens it. Past its size
+// limit, only what fits is appended, followed by the truncation
+// marker. The time and lines of the write are indexed.
+//
+// Readers are notified with the offset and data appended when small
+// enough, in the form "offset:data". Larger writes only publish 1,
+// readers fetching what they missed.
+//
+// Nothing is written to a channel which is gone, having expired or
+// been purged, nor to a sealed channel once closed. Neither is it
+// to a compressed channel whose last segment, compressed on close,
+// must be restored first.
+//
+// The reply holds, in order: how much of the data was written, then
+// flags telling whether the channel got truncated, is gone, is
+// sealed, has a full segment to compress, and needs its last
+// segment restored.
+var appendChannel = redis.NewScript(3, luaIndex+luaSegments+`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return {0, 0, 1, 0, 0, 0}
+end
+
+local data = ARGV[1]
+local written, truncated = #data, 0
+if #data > 0 and redis.call('HEXISTS', KEYS[3], 'truncated') == 1 then
+  return {0, 1, 0, 0, 0, 0}
+end
+if redis.call('EXISTS', KEYS[2]) == 1 and redis.call('HEXISTS', KEYS[3], 'sealed') == 1 then
+  return {0, 0, 0, 1, 0, 0}
+end
+if compressedTail(KEYS[1]) then
+  return {0, 0, 0, 0, 0, 1}
+end
+
+local max = tonumber(redis.call('HGET', KEYS[3], 'max_size')) or tonumber(ARGV[4])
+if max > 0 then
+  local room = math.max(max - channelSize(KEYS[1]), 0)
+  if #data > room then
+    written, truncated = room, 1
+    data = string.sub(data, 1, room) .. ARGV[5]
+    redis.call('HSET', KEYS[3], 'truncated', 1)
+  end
+end
+
+local size = appendData(KEYS[1], data)
+if #data > 0 then
+  markTime(KEYS[1], size - #data, ARGV[6])
+  markLines(KEYS[1], KEYS[3], size - #data, data)
+end
+local ttl = tonumber(redis.call('HGET', KEYS[3], 'channel_expire')) or tonumber(ARGV[2])
+redis.call('EXPIRE', KEYS[1], ttl)
+redis.call('EXPIRE', KEYS[3], ttl)
+expireSegments(KEYS[1], ttl)
+expireIndex(KEYS[1], ttl)
+redis.call('DEL', KEYS[2])
+redis.call('HSET', KEYS[3], 'updated_at', ARGV[6])
+redis.call('HDEL', KEYS[3], 'closed_at')
+if #data <= tonumber(ARGV[3]) then
+  redis.call('PUBLISH', KEYS[1], (size - #data) .. ':' .. data)
+else
+  redis.call('PUBLISH', KEYS[1], 1)
+end
+local compressible = 0
+if compressibleSegment(KEYS[1]) then
+  compressible = 1
+end
+return {written, truncated, 0, 0, compressible, 0}
+`)
+
 func (w *writer) Write(p []byte) (int, error) {
-	conn := redisPool.Get()
+	conn := w.broker.pool.Get(w.channel.id())
 	defer conn.Close()
 
-	conn.Send("MULTI")
-	conn.Send("APPEND", w.channel.id(), p)
-	conn.Send("EXPIRE", w.channel.id(), redisChannelExpire)
-	conn.Send("DEL", w.channel.doneID())
-	conn.Send("PUBLISH", w.channel.id(), 1)
+	reply, err := w.append(conn, p)
+	for err == nil && reply[5] == 1 {
+		// The channel got reopened, its last segment
+		// is stored back raw to be appended to.
+		if err = w.broker.restoreTail(conn, w.channel); err == nil {
+			reply, err = w.append(conn, p)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if reply[2] == 1 {
+		return 0, ErrNotRegistered
+	}
+	if reply[3] == 1 {
+		return 0, ErrClosed
+	}
+	if reply[4] == 1 {
+		w.compress()
+	}
+	if reply[1] == 1 {
+		util.CountWithData("RedisBroker.truncated", 1, "channel=%s", w.channel)
+		w.Close()
+		return reply[0], ErrTooLarge
+	}
+	return reply[0], nil
+}
 
-	_, err := conn.Do("EXEC")
-	return len(p), err
+func (w *writer) append(conn redis.Conn, p []byte) ([]int, error) {
+	return redis.Ints(appendChannel.Do(conn, w.channel.id(), w.channel.doneID(), w.channel.metaID(),
+		p, w.broker.channelExpire(), w.broker.opts.PublishLimit, w.broker.opts.MaxSize, TruncatedMarker, millis(time.Now())))
 }
 
 type reader struct {
+	broker   *RedisBroker
 	channel  channel
-	psc      redis.PubSubConn
+	sub      *subscription
 	offset   int64
 	replayed bool
 	closed   bool
+	closing  chan struct{}
 	mutex    *sync.Mutex
 	buffered bool
 }
 
-// NewReader creates a new redis channel reader
-func NewReader(key string) (io.ReadCloser, error) {
-	r, err := NewRedisRegistrar().IsRegistered(key)
+func newReader(b *RedisBroker, channel channel) (*reader, error) {
+	sub, err := b.hub.subscribe(channel)
 	if err != nil {
 		return nil, err
 	}
 
-	if !r {
-		return nil, ErrNotRegistered
-	}
-
-	psc := redis.PubSubConn{Conn: redisPool.Get()}
-	channel := channel(key)
-	psc.PSubscribe(channel.wildcardID())
-
-	rd := &reader{
+	return &reader{
+		broker:  b,
 		channel: channel,
-		psc:     psc,
-		mutex:   &sync.Mutex{}}
-
-	return rd, nil
+		sub:     sub,
+		closing: make(chan struct{}),
+		mutex:   &sync.Mutex{}}, nil
 }
 
 var errWhence = errors.New("Seek: invalid whence")
@@ -112,7 +211,7 @@ func (r *reader) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (r *reader) Read(p []byte) (n int, err error) {
-	if r.closed { // Don't read from a closed redigo connection
+	if r.isClosed() {
 		return 0, io.EOF
 	}
 
@@ -120,17 +219,14 @@ func (r *reader) Read(p []byte) (n int, err error) {
 		return n, err
 	}
 
-	switch msg := r.psc.Receive().(type) {
-	case redis.Message:
-	case redis.PMessage:
-		return r.read(msg, p)
-	case redis.Subscription:
-	case error:
-		util.CountWithData("RedisBroker.redisSubscribe.ReceiveError", 1, "err=%s", msg)
-		err = msg
-		return
+	select {
+	case <-r.sub.notify:
+		return r.read(atomic.LoadInt32(&r.sub.killed) == 1, p)
+	case <-r.sub.gone:
+		return 0, r.sub.err
+	case <-r.closing:
+		return 0, io.EOF
 	}
-	return
 }
 
 func (r *reader) replay(p []byte) (n int, err error) {
@@ -157,19 +253,22 @@ func (r *reader) replay(p []byte) (n int, err error) {
 	return n, err
 }
 
-func (r *reader) read(msg redis.PMessage, p []byte) (n int, err error) {
-	var buf []byte
+func (r *reader) read(killed bool, p []byte) (n int, err error) {
+	buf, err := r.fetch(len(p))
 
-	if msg.Channel == r.channel.killID() || msg.Channel == r.channel.id() {
-		buf, err = r.fetch(len(p))
+	if n = len(buf); n > 0 {
+		copy(p, buf)
+		r.offset += int64(n)
+	}
 
-		if n = len(buf); n > 0 {
-			copy(p, buf)
-			r.offset += int64(n)
-		}
+	// Notifications are coalesced, so there may be more
+	// than p can hold: replay the rest before waiting again.
+	if r.buffered && err == nil {
+		r.replayed = false
+		return n, nil
 	}
 
-	if msg.Channel == r.channel.killID() || err == io.EOF {
+	if killed || err == io.EOF {
 		util.Count("RedisBroker.redisSubscribe.Channel.kill")
 		r.Close()
 		err = io.EOF
@@ -179,131 +278,34 @@ func (r *reader) read(msg redis.PMessage, p []byte) (n int, err error) {
 }
 
 func (r *reader) fetch(length int) ([]byte, error) {
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	start, end := r.offset, r.offset+int64(length)
-
-	err := conn.Send("MULTI")
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("GETRANGE", r.channel.id(), start, end-1)
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("STRLEN", r.channel.id())
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("EXISTS", r.channel.doneID())
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
-	if err != nil {
-		return nil, err
-	}
-
-	list, err := redis.Values(conn.Do("EXEC"))
-	if err != nil {
-		return nil, err
-	}
-	data, err := redis.Bytes(list[0], err)
-	if err != nil {
-		return nil, err
-	}
-	size, err := redis.Int64(list[1], err)
-	if err != nil {
-		return nil, err
-	}
-	done, err := redis.Bool(list[2], err)
+	data, size, done, err := r.broker.cache.read(r.channel, r.offset, length)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.buffered = end < size; !r.buffered && done {
+	if r.buffered = r.offset+int64(len(data)) < size; !r.buffered && done {
 		err = io.EOF
 	}
 
 	return data, err
 }
 
-func (r *reader) Close() error {
-	if r.closed {
-		return nil
-	}
-
+func (r *reader) isClosed() bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-
-	r.closed = true
-	r.psc.Unsubscribe()
-	return r.psc.Close()
+	return r.closed
 }
 
-func readerDone(rd io.Reader) bool {
-	r, ok := rd.(*reader)
-	if !ok {
-		return false
-	}
+func (r *reader) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
 	if r.closed {
-		return true
-	}
-
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	done, _ := redis.Bool(conn.Do("EXISTS", r.channel.doneID()))
-	return done
-}
-
-// NoContent returns whether the channel already has content pushed or not
-func NoContent(rd io.Reader, offset int64) bool {
-	if !readerDone(rd) {
-		return false
-	}
-
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	strlen, err := redis.Int64(conn.Do("STRLEN", rd.(*reader).channel.id()))
-	if err != nil {
-		return false
-	}
-
-	return offset > (strlen - 1)
-}
-
-// RenewExpiry renews the channel expiration
-func RenewExpiry(rd io.Reader) {
-	r, ok := rd.(*reader)
-	if !ok {
-		return
-	}
-
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	conn.Send("MULTI")
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
-	conn.Do("EXEC")
-}
-
-// Len returns the length of data already send to the reader
-func Len(wd io.WriteCloser) (int64, error) {
-	w, ok := wd.(*writer)
-	if !ok {
-		return 0, errors.New("Cannot cast argument to `writer`")
-	}
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	strlen, err := redis.Int64(conn.Do("STRLEN", w.channel.id()))
-	if err != nil {
-		return 0, err
+		return nil
 	}
 
-	return strlen, nil
+	r.closed = true
+	close(r.closing)
+	r.broker.hub.unsubscribe(r.sub)
+	return nil
 }
@@ -6,27 +6,25 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"strings"
 	"testing"
 
 	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
 
+var redisBroker, _ = NewRedisBroker(&RedisOptions{URL: os.Getenv("REDIS_URL")})
+
 func setup() string {
-	registrar := NewRedisRegistrar()
 	uuid, _ := util.NewUUID()
-	registrar.Register(uuid)
+	redisBroker.Register(uuid)
 
 	return uuid
 }
 
 func newReaderWriter() (io.ReadCloser, io.WriteCloser) {
-	registrar := NewRedisRegistrar()
-	uuid, _ := util.NewUUID()
-	registrar.Register(uuid)
-	r, _ := NewReader(uuid)
-	w, _ := NewWriter(uuid)
+	uuid := setup()
+	r, _ := redisBroker.NewReader(uuid)
+	w, _ := redisBroker.NewWriter(uuid)
 
 	return r, w
 }
@@ -34,7 +32,7 @@ func newReaderWriter() (io.ReadCloser, io.WriteCloser) {
 func Example_pub_sub() {
 	uuid := setup()
 
-	r, _ := NewReader(uuid)
+	r, _ := redisBroker.NewReader(uuid)
 	defer r.(io.Closer).Close()
 
 	pub := make(chan bool)
@@ -49,7 +47,7 @@ func Example_pub_sub() {
 	go func() {
 		pub <- true
 
-		w, _ := NewWriter(uuid)
+		w, _ := redisBroker.NewWriter(uuid)
 		w.Write([]byte("busl"))
 		w.Write([]byte(" hello"))
 		w.Write([]byte(" world"))
@@ -65,12 +63,12 @@ func Example_pub_sub() {
 func Example_full_replay() {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := redisBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 	w.Write([]byte(" hello"))
 	w.Write([]byte(" world"))
 
-	r, _ := NewReader(uuid)
+	r, _ := redisBroker.NewReader(uuid)
 	defer r.(io.Closer).Close()
 
 	buf := make([]byte, 16)
@@ -85,13 +83,13 @@ func Example_full_replay() {
 func TestSeekCorrect(t *testing.T) {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := redisBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 	w.Write([]byte(" hello"))
 	w.Write([]byte(" world"))
 	w.Close()
 
-	r, _ := NewReader(uuid)
+	r, _ := redisBroker.NewReader(uuid)
 	r.(io.Seeker).Seek(10, 0)
 	defer r.(io.Closer).Close()
 
@@ -102,13 +100,13 @@ func TestSeekCorrect(t *testing.T) {
 func TestSeekBeyond(t *testing.T) {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := redisBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 	w.Write([]byte(" hello"))
 	w.Write([]byte(" world"))
 	w.Close()
 
-	r, _ := NewReader(uuid)
+	r, _ := redisBroker.NewReader(uuid)
 	r.(io.Seeker).Seek(16, 0)
 	defer r.Close()
 
@@ -119,10 +117,10 @@ func TestSeekBeyond(t *testing.T) {
 func Example_half_replay_half_subscribed() {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := redisBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 
-	r, _ := NewReader(uuid)
+	r, _ := redisBroker.NewReader(uuid)
 
 	pub := make(chan bool)
 	done := make(chan bool)
@@ -150,7 +148,7 @@ func Example_half_replay_half_subscribed() {
 func TestOverflowingBuffer(t *testing.T) {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := redisBroker.NewWriter(uuid)
 	w.Write(bytes.Repeat([]byte("0"), 4096))
 	w.Write(bytes.Repeat([]byte("1"), 4096))
 	w.Write(bytes.Repeat([]byte("2"), 4096))
@@ -161,7 +159,7 @@ func TestOverflowingBuffer(t *testing.T) {
 	w.Write(bytes.Repeat([]byte("7"), 4096))
 	w.Write(bytes.Repeat([]byte("A"), 1))
 
-	r, _ := NewReader(uuid)
+	r, _ := redisBroker.NewReader(uuid)
 	defer r.(io.Closer).Close()
 
 	done := make(chan int64)
@@ -208,32 +206,23 @@ func TestRedisReadFromClosed(t *testing.T) {
 	_, err := r.Read(p)
 	assert.Equal(t, err, io.EOF)
 
-	// We'll get true here because r.closed is already set
-	assert.True(t, readerDone(r))
-
-	// We should still get true here because doneID is set
-	r, _ = NewReader(string(r.(*reader).channel))
-	assert.True(t, readerDone(r))
-
-	// Reader done on a regular io.Reader should return false
-	// and not panic
-	assert.False(t, readerDone(strings.NewReader("hello")))
-
-	// NoContent should respond accordingly based on offset
-	assert.False(t, NoContent(r, 0))
-	assert.True(t, NoContent(r, 5))
+	// We should get true here because doneID is set
+	done, err := redisBroker.Done(string(r.(*reader).channel))
+	assert.Nil(t, err)
+	assert.True(t, done)
 }
 
 func TestLen(t *testing.T) {
-	_, w := newReaderWriter()
+	uuid := setup()
+	w, _ := redisBroker.NewWriter(uuid)
 
-	l, err := Len(w)
+	l, err := redisBroker.Len(uuid)
 	assert.Nil(t, err)
 	assert.Equal(t, int64(0), l)
 
 	w.Write([]byte("hello"))
 
-	l, err = Len(w)
+	l, err = redisBroker.Len(uuid)
 	assert.Nil(t, err)
 	assert.Equal(t, int64(5), l)
 }
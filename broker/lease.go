@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultLeaseTTL is how long a publisher lease lasts unless renewed.
+const DefaultLeaseTTL = 30 * time.Second
+
+// acquireLease sets the lease key to the publisher token, unless
+// it's held with another token. An empty token only checks that.
+var acquireLease = redis.NewScript(1, `
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+  return 0
+end
+if ARGV[1] ~= '' then
+  redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+end
+return 1
+`)
+
+// releaseLease deletes the lease key if it's held with the token.
+var releaseLease = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Lease acquires, or renews, the publisher lease of the channel.
+func (b *RedisBroker) Lease(key, token string, ttl time.Duration) error {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	acquired, err := redis.Bool(acquireLease.Do(conn, channel.leaseID(), token, int64(ttl/time.Millisecond)))
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return ErrLeased
+	}
+	return nil
+}
+
+// ReleaseLease releases the publisher lease held with token.
+func (b *RedisBroker) ReleaseLease(key, token string) error {
+	if token == "" {
+		return nil
+	}
+
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	_, err := releaseLease.Do(conn, channel.leaseID(), token)
+	return err
+}
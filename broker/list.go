@@ -0,0 +1,232 @@
+package broker
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultListCount is the number of channels listed at once by default.
+const DefaultListCount = 100
+
+// ListOptions filters the channels being listed. Zero values
+// don't filter anything.
+type ListOptions struct {
+	Prefix    string        // of the channel keys
+	Closed    *bool         // only closed, or open, channels
+	OlderThan time.Duration // created at least that long ago
+	NewerThan time.Duration // created at most that long ago
+	Cursor    string        // as returned by the previous call
+	Count     int           // hint of the number of channels to return
+}
+
+// ChannelInfo describes a listed channel.
+type ChannelInfo struct {
+	Key string `json:"key"`
+	Metadata
+}
+
+func (o *ListOptions) match(meta *Metadata, now time.Time) bool {
+	if o.Closed != nil && *o.Closed != meta.Closed {
+		return false
+	}
+	if o.OlderThan > 0 && now.Sub(meta.CreatedAt) < o.OlderThan {
+		return false
+	}
+	if o.NewerThan > 0 && now.Sub(meta.CreatedAt) > o.NewerThan {
+		return false
+	}
+	return true
+}
+
+func (o *ListOptions) count() int {
+	if o.Count <= 0 {
+		return DefaultListCount
+	}
+	return o.Count
+}
+
+// describeChannel returns the layout, size and done flag of a
+// channel, followed by the fields of its meta hash.
+var describeChannel = redis.NewScript(3, luaSegments+`
+local layout = redis.call('TYPE', KEYS[1]).ok
+local size = 0
+if layout == 'string' or layout == 'hash' then
+  size = channelSize(KEYS[1])
+elseif layout == 'stream' then
+  local last = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+  if last[1] then
+    local fields = last[1][2]
+    for i = 1, #fields, 2 do
+      if fields[i] == 'offset' then
+        size = tonumber(fields[i + 1])
+      end
+    end
+  end
+end
+return {layout, size, redis.call('EXISTS', KEYS[2]), redis.call('HGETALL', KEYS[3])}
+`)
+
+func parseMetadata(reply interface{}, err error) (*Metadata, error) {
+	list, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if layout, _ := redis.String(list[0], nil); layout == "none" {
+		return nil, ErrNotRegistered
+	}
+	fields, err := redis.StringMap(list[3], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{
+		Creator:     fields[metaCreator],
+		ContentType: fields[metaContentType],
+		Truncated:   fields[metaTruncated] != "",
+		Sealed:      fields[metaSealed] != "",
+	}
+	meta.Generation, _ = strconv.ParseInt(fields[metaGeneration], 10, 64)
+	meta.Lines, _ = strconv.ParseInt(fields[metaLines], 10, 64)
+	meta.Size, _ = redis.Int64(list[1], nil)
+	meta.Closed, _ = redis.Bool(list[2], nil)
+	if t := parseMillis(fields[metaCreatedAt]); t != nil {
+		meta.CreatedAt = *t
+	}
+	meta.UpdatedAt = parseMillis(fields[metaUpdatedAt])
+	meta.ClosedAt = parseMillis(fields[metaClosedAt])
+	return meta, nil
+}
+
+// List returns the channels matching opts, scanning the channel keys
+// of every node. The returned cursor is empty once all the channels
+// have been listed.
+func (b *RedisBroker) List(opts *ListOptions) ([]ChannelInfo, string, error) {
+	nodes := b.pool.masters()
+	node, cursor, err := parseListCursor(opts.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var channels []ChannelInfo
+	for node < len(nodes) && len(channels) < opts.count() {
+		var keys []string
+		if cursor, keys, err = b.scan(nodes[node], cursor, opts); err != nil {
+			return nil, "", err
+		}
+
+		found, err := b.describe(nodes[node], keys, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		channels = append(channels, found...)
+
+		if cursor == "0" {
+			node, cursor = node+1, "0"
+		}
+	}
+
+	if node >= len(nodes) {
+		return channels, "", nil
+	}
+	return channels, strconv.Itoa(node) + "-" + cursor, nil
+}
+
+// parseListCursor reads cursors made of the index of the node
+// being scanned and of its SCAN cursor.
+func parseListCursor(cursor string) (int, string, error) {
+	if cursor == "" {
+		return 0, "0", nil
+	}
+
+	i := strings.IndexByte(cursor, '-')
+	if i < 0 {
+		return 0, "", ErrInvalidCursor
+	}
+	node, err := strconv.Atoi(cursor[:i])
+	if err != nil || node < 0 {
+		return 0, "", ErrInvalidCursor
+	}
+	if _, err := strconv.ParseUint(cursor[i+1:], 10, 64); err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return node, cursor[i+1:], nil
+}
+
+// scan returns the keys of the channels found by a SCAN iteration,
+// stripped from the key prefix and cluster hash tag.
+func (b *RedisBroker) scan(node, cursor string, opts *ListOptions) (string, []string, error) {
+	conn := b.pool.GetNode(node)
+	defer conn.Close()
+
+	pattern := escapeGlob(b.opts.KeyPrefix+opts.Prefix) + "*"
+	if b.opts.Cluster {
+		pattern = "{" + pattern + "}"
+	}
+	pattern += ":id"
+
+	reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", opts.count()))
+	if err != nil {
+		return "", nil, err
+	}
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	ids, err := redis.Strings(reply[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		key := strings.TrimSuffix(id, ":id")
+		if b.opts.Cluster {
+			key = strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+		}
+		keys = append(keys, strings.TrimPrefix(key, b.opts.KeyPrefix))
+	}
+	sort.Strings(keys)
+	return next, keys, nil
+}
+
+// describe returns the metadata of the given channels matching opts,
+// pipelining the lookups.
+func (b *RedisBroker) describe(node string, keys []string, opts *ListOptions) ([]ChannelInfo, error) {
+	conn := b.pool.GetNode(node)
+	defer conn.Close()
+
+	for _, key := range keys {
+		c := b.channel(key)
+		if err := describeChannel.Send(conn, c.id(), c.doneID(), c.metaID()); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	channels := make([]ChannelInfo, 0, len(keys))
+	for _, key := range keys {
+		meta, err := parseMetadata(conn.Receive())
+		if err == ErrNotRegistered {
+			continue // expired meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opts.match(meta, now) {
+			channels = append(channels, ChannelInfo{key, *meta})
+		}
+	}
+	return channels, nil
+}
+
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
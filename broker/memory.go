@@ -0,0 +1,506 @@
+package broker
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is a broker keeping channel data in process memory.
+// It follows the same semantics as the redis broker, which makes it
+// suitable for development and tests.
+type MemoryBroker struct {
+	mutex      *sync.Mutex
+	channels   map[string]*memoryChannel
+	tombstones map[string]time.Time // purged keys, until they can be reused
+	leases     map[string]memoryLease
+}
+
+type memoryLease struct {
+	token   string
+	expires time.Time
+}
+
+type memoryChannel struct {
+	mutex   *sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	done    bool
+	expires time.Time
+
+	channelExpire time.Duration
+	keyExpire     time.Duration
+	maxSize       int64
+	truncated     bool
+	purged        bool
+	meta          Metadata
+	times         []TimeMark
+	lines         []LineMark
+}
+
+// NewMemoryBroker creates a new in-memory broker instance
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		mutex:      &sync.Mutex{},
+		channels:   make(map[string]*memoryChannel),
+		tombstones: make(map[string]time.Time),
+		leases:     make(map[string]memoryLease),
+	}
+}
+
+func (c *memoryChannel) expire(d time.Duration) {
+	c.expires = time.Now().Add(d)
+}
+
+// touch records a write, which reopens a closed channel
+// unless it's the one closing it.
+func (c *memoryChannel) touch(closing bool) {
+	now := time.Now()
+	c.meta.UpdatedAt = &now
+	c.meta.ClosedAt = nil
+	if closing {
+		c.meta.ClosedAt = &now
+	}
+}
+
+// markTime indexes a write starting at offset, if TimeResolution
+// has elapsed since the last one indexed.
+func (c *memoryChannel) markTime(offset int64) {
+	now := time.Now()
+	if n := len(c.times); n == 0 || now.Sub(c.times[n-1].Time) >= TimeResolution {
+		c.times = append(c.times, TimeMark{now, offset})
+	}
+}
+
+// markLines counts the lines of data, appended at offset, marking
+// every LineInterval-th one.
+func (c *memoryChannel) markLines(offset int64, data []byte) {
+	for i, b := range data {
+		if b != '\n' {
+			continue
+		}
+		if c.meta.Lines++; c.meta.Lines%LineInterval == 0 {
+			c.lines = append(c.lines, LineMark{c.meta.Lines + 1, offset + int64(i) + 1})
+		}
+	}
+}
+
+// channel returns the registered channel for key, or nil
+// if it was never registered or has expired.
+func (b *MemoryBroker) channel(key string) *memoryChannel {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.channels[key]
+	if !ok {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Now().After(c.expires) {
+		delete(b.channels, key)
+		return nil
+	}
+	return c
+}
+
+// Register registers the new channel
+func (b *MemoryBroker) Register(key string) error {
+	return b.RegisterWithOptions(key, nil)
+}
+
+// RegisterWithOptions registers the new channel with its own settings
+func (b *MemoryBroker) RegisterWithOptions(key string, opts *ChannelOptions) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if until, ok := b.tombstones[key]; ok && time.Now().Before(until) {
+		return ErrPurged
+	}
+	delete(b.tombstones, key)
+
+	var generation int64
+	if old, ok := b.channels[key]; ok {
+		old.mutex.Lock()
+		exists := time.Now().Before(old.expires)
+		generation = old.meta.Generation
+		if exists && opts != nil && opts.Reset {
+			// Readers of the previous generation stop, as when purged.
+			old.purged, old.done = true, true
+			old.cond.Broadcast()
+		}
+		old.mutex.Unlock()
+
+		if exists && (opts == nil || !opts.Reset) {
+			return ErrExists
+		}
+	}
+
+	c := &memoryChannel{
+		mutex:         &sync.Mutex{},
+		channelExpire: DefaultChannelExpire,
+		keyExpire:     DefaultKeyExpire,
+	}
+	if opts != nil && opts.ChannelExpire > 0 {
+		c.channelExpire = opts.ChannelExpire
+	}
+	if opts != nil && opts.KeyExpire > 0 {
+		c.keyExpire = opts.KeyExpire
+	}
+	if opts != nil {
+		c.maxSize = opts.MaxSize
+		c.meta.Creator = opts.Creator
+		c.meta.ContentType = opts.ContentType
+	}
+	c.meta.Sealed = opts == nil || !opts.Reopenable
+	c.meta.CreatedAt = time.Now()
+	c.meta.Generation = generation + 1
+	c.cond = sync.NewCond(c.mutex)
+	c.expire(c.channelExpire)
+	b.channels[key] = c
+	return nil
+}
+
+// IsRegistered checks whether a channel name is registered
+func (b *MemoryBroker) IsRegistered(key string) (bool, error) {
+	return b.channel(key) != nil, nil
+}
+
+// NewReader creates a new in-memory channel reader
+func (b *MemoryBroker) NewReader(key string) (io.ReadCloser, error) {
+	c := b.channel(key)
+	if c == nil {
+		return nil, ErrNotRegistered
+	}
+	return &memoryReader{channel: c}, nil
+}
+
+// NewWriter creates a new in-memory channel writer
+func (b *MemoryBroker) NewWriter(key string) (io.WriteCloser, error) {
+	c := b.channel(key)
+	if c == nil {
+		return nil, ErrNotRegistered
+	}
+	return &memoryWriter{channel: c}, nil
+}
+
+// Len returns the length of the data already sent to the channel
+func (b *MemoryBroker) Len(key string) (int64, error) {
+	c := b.channel(key)
+	if c == nil {
+		return 0, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return int64(len(c.buf)), nil
+}
+
+// Done returns whether the channel is registered and closed
+func (b *MemoryBroker) Done(key string) (bool, error) {
+	c := b.channel(key)
+	if c == nil {
+		return false, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.done, nil
+}
+
+// RenewExpiry renews the channel expiration
+func (b *MemoryBroker) RenewExpiry(key string) error {
+	if c := b.channel(key); c != nil {
+		c.mutex.Lock()
+		c.expire(c.channelExpire)
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+// Meta returns the channel metadata
+func (b *MemoryBroker) Meta(key string) (*Metadata, error) {
+	c := b.channel(key)
+	if c == nil {
+		return nil, ErrNotRegistered
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	meta := c.meta
+	meta.Size = int64(len(c.buf))
+	meta.Closed = c.done
+	meta.Truncated = c.truncated
+	return &meta, nil
+}
+
+// List returns the channels matching opts, in key order. The
+// cursor is the last key returned.
+func (b *MemoryBroker) List(opts *ListOptions) ([]ChannelInfo, string, error) {
+	b.mutex.Lock()
+	var keys []string
+	for key := range b.channels {
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.Cursor {
+			keys = append(keys, key)
+		}
+	}
+	b.mutex.Unlock()
+	sort.Strings(keys)
+
+	now := time.Now()
+	var channels []ChannelInfo
+	for i, key := range keys {
+		if len(channels) == opts.count() {
+			return channels, keys[i-1], nil
+		}
+
+		meta, err := b.Meta(key)
+		if err == ErrNotRegistered {
+			continue
+		}
+		if opts.match(meta, now) {
+			channels = append(channels, ChannelInfo{key, *meta})
+		}
+	}
+	return channels, "", nil
+}
+
+// Lease acquires, or renews, the publisher lease of the channel
+func (b *MemoryBroker) Lease(key, token string, ttl time.Duration) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if l, ok := b.leases[key]; ok && l.token != token && now.Before(l.expires) {
+		return ErrLeased
+	}
+	if token != "" {
+		b.leases[key] = memoryLease{token, now.Add(ttl)}
+	}
+	return nil
+}
+
+// ReleaseLease releases the publisher lease held with token
+func (b *MemoryBroker) ReleaseLease(key, token string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if l, ok := b.leases[key]; ok && l.token == token {
+		delete(b.leases, key)
+	}
+	return nil
+}
+
+// Purge deletes the channel and wakes up its readers, which stop
+// right away. The key can't be registered again until grace has elapsed.
+func (b *MemoryBroker) Purge(key string, grace time.Duration) error {
+	b.mutex.Lock()
+	c, ok := b.channels[key]
+	delete(b.channels, key)
+	delete(b.leases, key)
+	if grace > 0 {
+		b.tombstones[key] = time.Now().Add(grace)
+	}
+	b.mutex.Unlock()
+
+	if ok {
+		c.mutex.Lock()
+		c.buf, c.purged, c.done = nil, true, true
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+// Index returns a copy of the channel index
+func (b *MemoryBroker) Index(key string) (*Index, error) {
+	c := b.channel(key)
+	if c == nil {
+		return nil, ErrNotRegistered
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return &Index{
+		Size:      int64(len(c.buf)),
+		LineCount: c.meta.Lines,
+		Times:     append([]TimeMark{}, c.times...),
+		Lines:     append([]LineMark{}, c.lines...),
+	}, nil
+}
+
+// TimeOffset returns the offset of the content written from t on
+func (b *MemoryBroker) TimeOffset(key string, t time.Time) (int64, error) {
+	index, err := b.Index(key)
+	if err != nil {
+		return 0, err
+	}
+	return index.TimeOffset(t), nil
+}
+
+// LineOffset returns the offset of the closest marked line up to line
+func (b *MemoryBroker) LineOffset(key string, line int64) (offset, marked int64, err error) {
+	index, err := b.Index(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, marked = index.LineOffset(line)
+	return offset, marked, nil
+}
+
+// Get returns a copy of the channel content
+func (b *MemoryBroker) Get(key string) ([]byte, error) {
+	c := b.channel(key)
+	if c == nil {
+		return nil, ErrNotRegistered
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte{}, c.buf...), nil
+}
+
+// NewSnapshotReader creates a reader of a copy of the channel content
+func (b *MemoryBroker) NewSnapshotReader(key string) (io.ReadCloser, error) {
+	buf, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &bytesSnapshot{bytes.NewReader(buf)}, nil
+}
+
+// bytesSnapshot keeps the Len and Seek methods of bytes.Reader,
+// which let the content length be known when archiving.
+type bytesSnapshot struct {
+	*bytes.Reader
+}
+
+func (s *bytesSnapshot) Close() error {
+	return nil
+}
+
+type memoryWriter struct {
+	channel *memoryChannel
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	c := w.channel
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.purged {
+		return 0, ErrNotRegistered
+	}
+	if c.done && c.meta.Sealed {
+		return 0, ErrClosed
+	}
+	if c.truncated && len(p) > 0 {
+		return 0, ErrTooLarge
+	}
+
+	if len(p) > 0 {
+		c.markTime(int64(len(c.buf)))
+	}
+	if room := c.maxSize - int64(len(c.buf)); c.maxSize > 0 && int64(len(p)) > room {
+		if room < 0 {
+			room = 0
+		}
+		c.markLines(int64(len(c.buf)), p[:room])
+		c.buf = append(c.buf, p[:room]...)
+		c.markLines(int64(len(c.buf)), []byte(TruncatedMarker))
+		c.buf = append(c.buf, TruncatedMarker...)
+		c.truncated = true
+		c.done = true
+		c.touch(true)
+		c.expire(c.keyExpire)
+		c.cond.Broadcast()
+		return int(room), ErrTooLarge
+	}
+
+	c.markLines(int64(len(c.buf)), p)
+	c.buf = append(c.buf, p...)
+	c.done = false
+	c.touch(false)
+	c.expire(c.channelExpire)
+	c.cond.Broadcast()
+	return len(p), nil
+}
+
+func (w *memoryWriter) Close() error {
+	c := w.channel
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.done = true
+	now := time.Now()
+	c.meta.ClosedAt = &now
+	c.expire(c.keyExpire)
+	c.cond.Broadcast()
+	return nil
+}
+
+type memoryReader struct {
+	channel *memoryChannel
+	offset  int64
+	closed  bool
+}
+
+func (r *memoryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case 0:
+		r.offset = offset
+	case 1:
+		r.offset += offset
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	return r.offset, nil
+}
+
+func (r *memoryReader) Read(p []byte) (int, error) {
+	c := r.channel
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		if r.closed || c.purged {
+			return 0, io.EOF
+		}
+
+		if size := int64(len(c.buf)); r.offset < size {
+			n := copy(p, c.buf[r.offset:])
+			r.offset += int64(n)
+			c.expire(c.channelExpire)
+
+			if c.done && r.offset == size {
+				return n, io.EOF
+			}
+			return n, nil
+		}
+
+		if c.done {
+			return 0, io.EOF
+		}
+		c.cond.Wait()
+	}
+}
+
+func (r *memoryReader) Close() error {
+	c := r.channel
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r.closed = true
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,276 @@
+package broker
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupMemory() (*MemoryBroker, string) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid)
+
+	return b, uuid
+}
+
+func Example_memory_pub_sub() {
+	b, uuid := setupMemory()
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+
+	done := make(chan bool)
+	go func() {
+		io.Copy(os.Stdout, r)
+		done <- true
+	}()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	<-done
+
+	//Output:
+	// busl hello world
+}
+
+func TestMemoryUnregistered(t *testing.T) {
+	b := NewMemoryBroker()
+
+	r, err := b.IsRegistered("missing")
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	_, err = b.NewReader("missing")
+	assert.Equal(t, ErrNotRegistered, err)
+
+	_, err = b.NewWriter("missing")
+	assert.Equal(t, ErrNotRegistered, err)
+}
+
+func TestMemorySeekAndDone(t *testing.T) {
+	b, uuid := setupMemory()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl hello world"))
+
+	l, err := b.Len(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(16), l)
+
+	done, _ := b.Done(uuid)
+	assert.False(t, done)
+	w.Close()
+	done, _ = b.Done(uuid)
+	assert.True(t, done)
+
+	r, _ := b.NewReader(uuid)
+	r.(io.Seeker).Seek(10, 0)
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, " world", string(buf))
+
+	buf, err = b.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "busl hello world", string(buf))
+}
+
+func TestMemoryCloseReader(t *testing.T) {
+	b, uuid := setupMemory()
+	r, _ := b.NewReader(uuid)
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	r.Close()
+	assert.Equal(t, io.EOF, <-done)
+}
+
+func TestMemoryRetention(t *testing.T) {
+	b := NewMemoryBroker()
+	b.RegisterWithOptions("1", &ChannelOptions{KeyExpire: time.Nanosecond})
+
+	w, _ := b.NewWriter("1")
+	w.Write([]byte("busl"))
+	w.Close()
+	time.Sleep(time.Millisecond)
+
+	r, err := b.IsRegistered("1")
+	assert.Nil(t, err)
+	assert.False(t, r)
+}
+
+func TestMemoryMaxSize(t *testing.T) {
+	b := NewMemoryBroker()
+	b.RegisterWithOptions("1", &ChannelOptions{MaxSize: 8})
+
+	w, _ := b.NewWriter("1")
+	w.Write([]byte("busl"))
+	n, err := w.Write([]byte(" hello"))
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, 4, n)
+
+	r, _ := b.NewReader("1")
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "busl hel"+TruncatedMarker, string(data))
+}
+
+func TestMemoryMeta(t *testing.T) {
+	b := NewMemoryBroker()
+	b.RegisterWithOptions("1", &ChannelOptions{Creator: "ci"})
+
+	w, _ := b.NewWriter("1")
+	w.Write([]byte("busl"))
+
+	meta, err := b.Meta("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", meta.Creator)
+	assert.Equal(t, int64(4), meta.Size)
+	assert.NotNil(t, meta.UpdatedAt)
+	assert.Nil(t, meta.ClosedAt)
+	assert.False(t, meta.Closed)
+}
+
+func TestMemoryList(t *testing.T) {
+	b := NewMemoryBroker()
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		b.Register(key)
+	}
+	w, _ := b.NewWriter("a/2")
+	w.Close()
+
+	channels, cursor, err := b.List(&ListOptions{Prefix: "a/", Count: 2})
+	assert.Nil(t, err)
+	assert.Len(t, channels, 2)
+	assert.Equal(t, "a/1", channels[0].Key)
+	assert.Equal(t, "a/2", channels[1].Key)
+
+	channels, cursor, err = b.List(&ListOptions{Prefix: "a/", Count: 2, Cursor: cursor})
+	assert.Nil(t, err)
+	assert.Equal(t, "", cursor)
+	assert.Len(t, channels, 1)
+	assert.Equal(t, "a/3", channels[0].Key)
+
+	open := false
+	channels, _, _ = b.List(&ListOptions{Closed: &open})
+	assert.Len(t, channels, 3)
+}
+
+func TestMemoryPurge(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1")
+
+	r, _ := b.NewReader("1")
+	w, _ := b.NewWriter("1")
+	w.Write([]byte("secret"))
+	r.Read(make([]byte, 6))
+
+	b.Purge("1", time.Minute)
+	_, err := r.Read(make([]byte, 6))
+	assert.Equal(t, io.EOF, err)
+	_, err = w.Write([]byte("more"))
+	assert.Equal(t, ErrNotRegistered, err)
+
+	registered, _ := b.IsRegistered("1")
+	assert.False(t, registered)
+	assert.Equal(t, ErrPurged, b.Register("1"))
+}
+
+func TestMemoryLease(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1")
+
+	assert.Nil(t, b.Lease("1", "a", time.Minute))
+	assert.Equal(t, ErrLeased, b.Lease("1", "b", time.Minute))
+	assert.Equal(t, ErrLeased, b.Lease("1", "", time.Minute))
+
+	b.ReleaseLease("1", "a")
+	assert.Nil(t, b.Lease("1", "b", time.Millisecond))
+
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, b.Lease("1", "a", time.Minute))
+}
+
+func TestMemoryRegisterExisting(t *testing.T) {
+	b := NewMemoryBroker()
+	assert.Nil(t, b.Register("1"))
+	assert.Equal(t, ErrExists, b.Register("1"))
+
+	r, _ := b.NewReader("1")
+	defer r.Close()
+
+	assert.Nil(t, b.RegisterWithOptions("1", &ChannelOptions{Reset: true}))
+	meta, _ := b.Meta("1")
+	assert.Equal(t, int64(2), meta.Generation)
+
+	// Readers of the previous generation stop
+	_, err := r.Read(make([]byte, 8))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMemorySealed(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1")
+	w, _ := b.NewWriter("1")
+	w.Close()
+
+	_, err := w.Write([]byte("busl"))
+	assert.Equal(t, ErrClosed, err)
+
+	b.RegisterWithOptions("2", &ChannelOptions{Reopenable: true})
+	w, _ = b.NewWriter("2")
+	w.Close()
+	_, err = w.Write([]byte("busl"))
+	assert.Nil(t, err)
+}
+
+func TestMemoryIndex(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1")
+	w, _ := b.NewWriter("1")
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+
+	index, err := b.Index("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), index.Size)
+	assert.Len(t, index.Times, 1)
+
+	o, _ := b.TimeOffset("1", time.Now().Add(time.Hour))
+	assert.Equal(t, int64(10), o)
+
+	_, err = b.Index("2")
+	assert.Equal(t, ErrNotRegistered, err)
+}
+
+func TestMemoryLineIndex(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1")
+	w, _ := b.NewWriter("1")
+	for i := 0; i < 5; i++ {
+		w.Write(bytes.Repeat([]byte("x\n"), 500))
+	}
+
+	index, _ := b.Index("1")
+	assert.Equal(t, []LineMark{{1001, 2000}, {2001, 4000}}, index.Lines)
+
+	offset, marked, err := b.LineOffset("1", 1500)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), offset)
+	assert.Equal(t, int64(1001), marked)
+
+	meta, _ := b.Meta("1")
+	assert.Equal(t, int64(2500), meta.Lines)
+}
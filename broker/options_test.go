@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseURLOptions(t *testing.T) {
+	opts := &RedisOptions{
+		URL: "rediss://:secret@localhost:6380/2?max_active=50&wait=true&read_timeout=5s&dial_timeout=1s&tls_skip_verify=1",
+	}
+
+	server, err := opts.parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:6380", server.Host)
+	assert.True(t, opts.TLS)
+	assert.True(t, opts.TLSSkipVerify)
+	assert.True(t, opts.tlsConfig.InsecureSkipVerify)
+	assert.Equal(t, 2, opts.DB)
+	assert.Equal(t, 50, opts.MaxActive)
+	assert.True(t, opts.Wait)
+	assert.Equal(t, 5*time.Second, opts.ReadTimeout)
+	assert.Equal(t, time.Second, opts.DialTimeout)
+
+	// Defaults
+	assert.Equal(t, 3, opts.MaxIdle)
+	assert.Equal(t, 4*time.Minute, opts.IdleTimeout)
+	assert.Equal(t, StringLayout, opts.Layout)
+}
+
+func TestCompressionDefaults(t *testing.T) {
+	opts := &RedisOptions{URL: "redis://localhost:6379?compress=true"}
+
+	_, err := opts.parse()
+	assert.Nil(t, err)
+	assert.Equal(t, SegmentLayout, opts.Layout)
+	assert.Equal(t, DefaultCompressedSegmentSize, opts.SegmentSize)
+}
+
+func TestExplicitOptionsOverrideURL(t *testing.T) {
+	opts := &RedisOptions{
+		URL:       "redis://localhost:6379/2?max_active=50",
+		DB:        3,
+		MaxActive: 10,
+	}
+
+	_, err := opts.parse()
+	assert.Nil(t, err)
+	assert.False(t, opts.TLS)
+	assert.Nil(t, opts.tlsConfig)
+	assert.Equal(t, 3, opts.DB)
+	assert.Equal(t, 10, opts.MaxActive)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opts := range []*RedisOptions{
+		{URL: "redis://localhost:6379/db"},
+		{URL: "redis://localhost:6379?max_active=many"},
+		{URL: "redis://localhost:6379?read_timeout=5"},
+		{URL: "redis://localhost:6379/1", Cluster: true},
+		{URL: "rediss://localhost:6379?tls_ca_file=/does/not/exist"},
+		{URL: "redis://localhost:6379", Layout: "list"},
+		{URL: "redis://localhost:6379?compress=true", Layout: StreamLayout},
+		{URL: "redis://localhost:6379?publish_limit=512", CacheSize: -1},
+		{URL: "redis://localhost:6379", SentinelAddrs: []string{"localhost:26379"}},
+	} {
+		_, err := opts.parse()
+		assert.NotNil(t, err, opts.URL)
+	}
+}
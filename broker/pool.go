@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// pool hands out connections to the redis node owning a key.
+// Without cluster mode there is a single node: either the server
+// from the redis URL, or the master reported by the sentinels.
+type pool struct {
+	server   *url.URL
+	opts     *RedisOptions
+	sentinel *sentinel // nil unless sentinel discovery is enabled
+	cluster  *cluster  // nil unless cluster mode is enabled
+
+	mutex    *sync.Mutex
+	nodes    map[string]*redis.Pool // by node address
+	blocking map[string]*redis.Pool // by node address, without read timeout
+	c        int64
+}
+
+func newPool(server *url.URL, opts *RedisOptions) *pool {
+	cleanServerURL := *server
+	cleanServerURL.User = nil
+	log.Printf("connecting to redis: %s", cleanServerURL.String())
+
+	p := &pool{
+		server:   server,
+		opts:     opts,
+		mutex:    &sync.Mutex{},
+		nodes:    make(map[string]*redis.Pool),
+		blocking: make(map[string]*redis.Pool),
+	}
+
+	if len(opts.SentinelAddrs) > 0 {
+		p.sentinel = newSentinel(opts.SentinelAddrs, opts.SentinelMaster, p.dialSentinel)
+	}
+	if opts.Cluster {
+		p.cluster = newCluster(server.Host, func(addr string) (redis.Conn, error) {
+			return p.dial(addr, p.opts.ReadTimeout)
+		})
+	}
+	return p
+}
+
+// Get returns a connection to the node owning key.
+func (p *pool) Get(key string) Conn {
+	return p.get(key, false)
+}
+
+// GetBlocking returns a connection to the node owning key, meant
+// for commands blocking until data is available such as pub/sub
+// or XREAD. Those connections aren't subject to the read timeout
+// nor to the active connections limit.
+func (p *pool) GetBlocking(key string) Conn {
+	return p.get(key, true)
+}
+
+// GetNode returns a connection to the node at addr,
+// as returned by masters.
+func (p *pool) GetNode(addr string) Conn {
+	return p.conn(addr, false)
+}
+
+// masters returns the addresses of the nodes holding channels,
+// the empty address standing for the single node outside cluster
+// mode.
+func (p *pool) masters() []string {
+	if p.cluster == nil {
+		return []string{""}
+	}
+	return p.cluster.masters()
+}
+
+func (p *pool) get(key string, blocking bool) Conn {
+	var addr string
+	if p.cluster != nil {
+		addr = p.cluster.addr(key)
+	}
+	return p.conn(addr, blocking)
+}
+
+func (p *pool) conn(addr string, blocking bool) Conn {
+	n := atomic.AddInt64(&p.c, 1)
+	util.SampleWithData("redis.connections", n, "at=acquire")
+	return Conn{p.node(addr, blocking).Get(), p, blocking}
+}
+
+// node returns the pool of connections to addr, the empty
+// address standing for the single node outside cluster mode.
+func (p *pool) node(addr string, blocking bool) *redis.Pool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	nodes := p.nodes
+	if blocking {
+		nodes = p.blocking
+	}
+	if node, ok := nodes[addr]; ok {
+		return node
+	}
+
+	readTimeout := p.opts.ReadTimeout
+	if blocking {
+		readTimeout = 0
+	}
+
+	node := &redis.Pool{
+		MaxIdle:     p.opts.MaxIdle,
+		IdleTimeout: p.opts.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			if addr != "" {
+				return p.dial(addr, readTimeout)
+			}
+			if p.sentinel == nil {
+				return p.dial(p.server.Host, readTimeout)
+			}
+
+			master, err := p.sentinel.master()
+			if err != nil {
+				return nil, err
+			}
+			return p.dial(master, readTimeout)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// After a failover, connections to the former
+			// master are discarded.
+			if p.sentinel != nil {
+				return checkMaster(c)
+			}
+
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	if !blocking {
+		node.MaxActive = p.opts.MaxActive
+		node.Wait = p.opts.Wait
+	}
+	nodes[addr] = node
+	return node
+}
+
+func (p *pool) dial(addr string, readTimeout time.Duration) (c redis.Conn, err error) {
+	if p.opts.TLS {
+		c, err = p.dialTLS(addr, readTimeout)
+	} else {
+		c, err = redis.DialTimeout("tcp", addr, p.opts.DialTimeout, readTimeout, p.opts.WriteTimeout)
+	}
+	if err != nil {
+		return
+	}
+
+	if err = p.auth(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if p.opts.DB != 0 {
+		if _, err = c.Do("SELECT", p.opts.DB); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// dialSentinel connects to a sentinel, over TLS when enabled, and
+// authenticates with the sentinel password, if any: sentinels don't
+// share the password of the nodes they monitor.
+func (p *pool) dialSentinel(addr string) (c redis.Conn, err error) {
+	if p.opts.TLS {
+		c, err = p.dialTLS(addr, sentinelTimeout)
+	} else {
+		c, err = redis.DialTimeout("tcp", addr, sentinelTimeout, sentinelTimeout, sentinelTimeout)
+	}
+	if err != nil || p.opts.SentinelPassword == "" {
+		return
+	}
+
+	if _, err = c.Do("AUTH", p.opts.SentinelPassword); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return
+}
+
+func (p *pool) dialTLS(addr string, readTimeout time.Duration) (redis.Conn, error) {
+	config := p.opts.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	dialer := &net.Dialer{Timeout: p.opts.DialTimeout}
+	netConn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewConn(netConn, readTimeout, p.opts.WriteTimeout), nil
+}
+
+func (p *pool) auth(c redis.Conn) error {
+	if p.server.User == nil {
+		return nil
+	}
+
+	pw, pwset := p.server.User.Password()
+	if !pwset {
+		return nil
+	}
+
+	_, err := c.Do("AUTH", pw)
+	return err
+}
+
+// Conn is a pooled redis connection
+type Conn struct {
+	redis.Conn
+	p        *pool
+	blocking bool
+}
+
+// Do sends a command and returns its reply. A command answered with
+// MOVED is retried once against the node now serving its slot, and
+// the slots mapping refreshed so that further commands are sent there.
+// One answered with ASK is retried once against the node its slot is
+// being migrated to, the mapping being unchanged until it's done.
+func (c Conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	if err == nil || c.p.cluster == nil || !isRedirection(err) {
+		return reply, err
+	}
+	util.CountWithData("redis.cluster.redirection", 1, "error=%s", err)
+
+	kind, addr, ok := redirection(err)
+	if kind == "MOVED" {
+		c.p.cluster.invalidate()
+	}
+
+	// Flushed pipelines and transactions can't be replayed
+	// from their last command alone.
+	if !ok || cmd == "" || cmd == "EXEC" {
+		return reply, err
+	}
+
+	target := c.p.conn(addr, c.blocking)
+	defer target.Close()
+	if kind == "ASK" {
+		target.Conn.Send("ASKING")
+	}
+	return target.Conn.Do(cmd, args...)
+}
+
+// Close releases the connection back to its pool
+func (c Conn) Close() error {
+	n := atomic.AddInt64(&c.p.c, -1)
+	util.SampleWithData("redis.connections", n, "at=release")
+	return c.Conn.Close()
+}
+
+func isRedirection(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ")
+}
+
+// redirection returns the kind and node address of a MOVED or ASK
+// redirection, formatted as "MOVED <slot> <host:port>".
+func redirection(err error) (kind, addr string, ok bool) {
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
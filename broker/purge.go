@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// purgedPayload is published on the kill channel of a purged
+// channel, so hubs drop its cached tail instead of refreshing it.
+const purgedPayload = "purged"
+
+// purgeChannel deletes every key of a channel, its publisher lease
+// included, and leaves a tombstone for grace seconds, if any, before
+// kicking its readers.
+var purgeChannel = redis.NewScript(5, luaIndex+luaSegments+`
+deleteSegments(KEYS[1])
+deleteIndex(KEYS[1])
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3], KEYS[5])
+if tonumber(ARGV[1]) > 0 then
+  redis.call('SET', KEYS[4], ARGV[2], 'EX', ARGV[1])
+end
+redis.call('PUBLISH', ARGV[3], ARGV[4])
+`)
+
+// Purge deletes the channel keys, whatever their layout, and kicks
+// its readers. A tombstone prevents the channel from being registered
+// again until grace has elapsed.
+func (b *RedisBroker) Purge(key string, grace time.Duration) error {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	_, err := purgeChannel.Do(conn, channel.id(), channel.doneID(), channel.metaID(), channel.tombstoneID(),
+		channel.leaseID(), int(grace/time.Second), millis(time.Now()), channel.killID(), purgedPayload)
+	if err != nil {
+		util.CountWithData("RedisBroker.Purge.error", 1, "error=%s", err)
+		return err
+	}
+
+	util.CountWithData("RedisBroker.purged", 1, "channel=%s", channel)
+	return nil
+}
@@ -1,152 +1,438 @@
 package broker
 
 import (
-	"flag"
-	"log"
-	"net/url"
-	"os"
-	"sync/atomic"
+	"bytes"
+	"io"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/heroku/busl/util"
 )
 
-var (
-	redisURL           = flag.String("redisUrl", os.Getenv("REDIS_URL"), "URL of the redis server")
-	redisServer        *url.URL
-	redisPool          *pool
-	redisKeyExpire     = 60 // redis uses seconds for EXPIRE
-	redisChannelExpire = redisKeyExpire * 60
-)
+type channel string
 
-type pool struct {
-	*redis.Pool
-	c int64
+func (c channel) id() string {
+	return string(c) + ":id"
+}
+
+func (c channel) wildcardID() string {
+	return string(c) + ":*"
 }
 
-func (p *pool) Get() Conn {
-	n := atomic.AddInt64(&p.c, 1)
-	util.SampleWithData("redis.connections", n, "at=acquire")
-	return Conn{p.Pool.Get(), p}
+func (c channel) doneID() string {
+	return string(c) + ":done"
 }
 
-type Conn struct {
-	redis.Conn
-	p *pool
+func (c channel) killID() string {
+	return string(c) + ":kill"
 }
 
-func (c Conn) Close() error {
-	n := atomic.AddInt64(&c.p.c, -1)
-	util.SampleWithData("redis.connections", n, "at=release")
-	return c.Conn.Close()
+func (c channel) metaID() string {
+	return string(c) + ":meta"
 }
 
-func init() {
-	flag.Parse()
-	redisServer, _ = url.Parse(*redisURL)
-	redisPool = newPool(redisServer)
+func (c channel) leaseID() string {
+	return string(c) + ":lease"
+}
 
-	conn := redisPool.Get()
-	defer conn.Close()
+func (c channel) timesID() string {
+	return string(c) + ":times"
 }
 
-func newPool(server *url.URL) *pool {
-	cleanServerURL := *server
-	cleanServerURL.User = nil
-	log.Printf("connecting to redis: %s", cleanServerURL.String())
-	p := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 4 * time.Minute,
-		Dial: func() (c redis.Conn, err error) {
-			c, err = redis.Dial("tcp", server.Host)
-			if err != nil {
-				return
-			}
+func (c channel) linesID() string {
+	return string(c) + ":lines"
+}
+
+func (c channel) entriesID() string {
+	return string(c) + ":entries"
+}
+
+func (c channel) tombstoneID() string {
+	return string(c) + ":tombstone"
+}
+
+// Fields of the channel meta hash
+const (
+	metaChannelExpire = "channel_expire"
+	metaKeyExpire     = "key_expire"
+	metaMaxSize       = "max_size"
+	metaCreator       = "creator"
+	metaContentType   = "content_type"
+	metaCreatedAt     = "created_at" // timestamps in milliseconds
+	metaUpdatedAt     = "updated_at"
+	metaClosedAt      = "closed_at"
+	metaTruncated     = "truncated"
+	metaGeneration    = "generation"
+	metaSealed        = "sealed"
+	metaLines         = "lines"
+)
 
-			if server.User == nil {
-				return
-			}
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// expireChannel sets the expiry of the given keys from a field of
+// the meta hash (KEYS[1]), falling back to the broker default.
+// The segments and index of the channel KEYS[2] expire along.
+var expireChannel = redis.NewScript(-1, luaIndex+luaSegments+`
+local ttl = tonumber(redis.call('HGET', KEYS[1], ARGV[1])) or tonumber(ARGV[2])
+for i = 1, #KEYS do
+  redis.call('EXPIRE', KEYS[i], ttl)
+end
+expireSegments(KEYS[2], ttl)
+expireIndex(KEYS[2], ttl)
+return ttl
+`)
 
-			pw, pwset := server.User.Password()
-			if !pwset {
-				return
-			}
+// RedisBroker is a broker storing channel data on redis
+type RedisBroker struct {
+	pool  *pool
+	hub   *hub
+	cache *tailCache
+	opts  RedisOptions
+}
 
-			if _, err = c.Do("AUTH", pw); err != nil {
-				c.Close()
-				return
-			}
-			return
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+// NewRedisBroker creates a new redis broker instance.
+// Connections are established lazily on first use.
+func NewRedisBroker(opts *RedisOptions) (*RedisBroker, error) {
+	b := &RedisBroker{opts: *opts}
+	server, err := b.opts.parse()
+	if err != nil {
+		return nil, err
 	}
 
-	return &pool{p, 0}
+	b.pool = newPool(server, &b.opts)
+	b.cache = newTailCache(int64(b.opts.CacheSize), b.getRange)
+	b.hub = newHub(b.pool, b.cache)
+	return b, nil
 }
 
-type channel string
+// Options returns the options in effect, once the ones carried by
+// the URL and the defaults have been applied.
+func (b *RedisBroker) Options() RedisOptions {
+	return b.opts
+}
 
-func (c channel) id() string {
-	return string(c) + ":id"
+// In cluster mode, the channel name is used as hash tag so
+// all the keys of a channel are stored on the same node.
+func (b *RedisBroker) channel(key string) channel {
+	if b.opts.Cluster {
+		return channel("{" + b.opts.KeyPrefix + key + "}")
+	}
+	return channel(b.opts.KeyPrefix + key)
 }
 
-func (c channel) wildcardID() string {
-	return string(c) + ":*"
+// getRange reads the data of a string or segment layout channel
+// between start and end, along with its size and whether it's done.
+// The channel expiry is renewed as it's being read.
+func (b *RedisBroker) getRange(c channel, start, end int64) (data []byte, size int64, done bool, err error) {
+	conn := b.pool.Get(c.id())
+	defer conn.Close()
+
+	list, err := redis.Values(readRange.Do(conn, c.id(), c.doneID(), c.metaID(), start, end-1, b.channelExpire()))
+	if err != nil {
+		return
+	}
+	if data, err = joinParts(list[0]); err != nil {
+		return
+	}
+	if size, err = redis.Int64(list[1], nil); err != nil {
+		return
+	}
+	done, err = redis.Bool(list[2], nil)
+	return
 }
 
-func (c channel) doneID() string {
-	return string(c) + ":done"
+// Redis uses seconds for EXPIRE
+func (b *RedisBroker) keyExpire() int {
+	return int(b.opts.KeyExpire / time.Second)
 }
 
-func (c channel) killID() string {
-	return string(c) + ":kill"
+func (b *RedisBroker) channelExpire() int {
+	return int(b.opts.ChannelExpire / time.Second)
 }
 
-// RedisRegistrar is a channel storing data on redis
-type RedisRegistrar struct{}
+// sendRenewExpiry queues the renewal of the channel expiry,
+// using the one the channel was registered with if any.
+func (b *RedisBroker) sendRenewExpiry(conn redis.Conn, c channel) error {
+	return expireChannel.Send(conn, 2, c.metaID(), c.id(), metaChannelExpire, b.channelExpire())
+}
 
-// NewRedisRegistrar creates a new registrar instance
-func NewRedisRegistrar() *RedisRegistrar {
-	registrar := &RedisRegistrar{}
+// sendCloseExpiry queues the expiry of a closed channel.
+func (b *RedisBroker) sendCloseExpiry(conn redis.Conn, c channel) error {
+	return expireChannel.Send(conn, 3, c.metaID(), c.id(), c.doneID(), metaKeyExpire, b.keyExpire())
+}
 
-	return registrar
+// layout returns the layout the channel was registered with,
+// so channels created before a layout change keep working.
+// An empty layout is returned for unregistered channels.
+func (b *RedisBroker) layout(conn redis.Conn, c channel) (Layout, error) {
+	t, err := redis.String(conn.Do("TYPE", c.id()))
+	if err != nil {
+		return "", err
+	}
+
+	switch t {
+	case "string":
+		return StringLayout, nil
+	case "stream":
+		return StreamLayout, nil
+	case "hash":
+		return SegmentLayout, nil
+	}
+	return "", nil
 }
 
+// resetPayload is published on the kill channel of a channel
+// registered again, so hubs drop its cached tail and the readers
+// of the previous generation stop.
+const resetPayload = "reset"
+
 // Register registers the new channel
-func (rr *RedisRegistrar) Register(channelName string) (err error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) Register(channelName string) error {
+	return b.RegisterWithOptions(channelName, nil)
+}
+
+// RegisterWithOptions registers the new channel with its own settings,
+// kept in the channel meta hash. The channel keys are watched while
+// it's checked, so concurrent registrations can't both succeed.
+func (b *RedisBroker) RegisterWithOptions(channelName string, opts *ChannelOptions) (err error) {
+	channel := b.channel(channelName)
+	conn := b.pool.Get(channel.id())
 	defer conn.Close()
 
-	channel := channel(channelName)
-	_, err = conn.Do("SETEX", channel.id(), redisChannelExpire, make([]byte, 0))
+	if _, err := conn.Do("WATCH", channel.id(), channel.metaID(), channel.tombstoneID()); err != nil {
+		return err
+	}
+	conn.Send("EXISTS", channel.tombstoneID())
+	conn.Send("EXISTS", channel.id())
+	conn.Send("HGET", channel.metaID(), metaGeneration)
+	state, err := redis.Values(conn.Do(""))
 	if err != nil {
-		util.CountWithData("RedisRegistrar.Register.error", 1, "error=%s", err)
+		return err
+	}
+
+	purged, _ := redis.Bool(state[0], nil)
+	exists, _ := redis.Bool(state[1], nil)
+	generation, _ := redis.Int64(state[2], nil)
+	switch {
+	case purged:
+		return ErrPurged
+	case exists && (opts == nil || !opts.Reset):
+		return ErrExists
+	}
+
+	meta := redis.Args{}.Add(channel.metaID(), metaCreatedAt, millis(time.Now()), metaGeneration, generation+1)
+	if opts != nil && opts.Creator != "" {
+		meta = meta.Add(metaCreator, opts.Creator)
+	}
+	if opts != nil && opts.ContentType != "" {
+		meta = meta.Add(metaContentType, opts.ContentType)
+	}
+	if opts != nil && opts.ChannelExpire > 0 {
+		meta = meta.Add(metaChannelExpire, int(opts.ChannelExpire/time.Second))
+	}
+	if opts != nil && opts.KeyExpire > 0 {
+		meta = meta.Add(metaKeyExpire, int(opts.KeyExpire/time.Second))
+	}
+	if opts != nil && opts.MaxSize > 0 {
+		meta = meta.Add(metaMaxSize, opts.MaxSize)
+	}
+	if opts == nil || !opts.Reopenable {
+		meta = meta.Add(metaSealed, 1)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", channel.metaID(), channel.doneID(), channel.timesID(), channel.linesID(), channel.entriesID())
+	switch b.opts.Layout {
+	case StreamLayout:
+		conn.Send("DEL", channel.id())
+		conn.Send("XADD", channel.id(), "*", "offset", 0, "data", "")
+	case SegmentLayout:
+		resetSegments.Send(conn, channel.id(), b.opts.SegmentSize, b.opts.Compress)
+	default:
+		conn.Send("SET", channel.id(), make([]byte, 0))
+	}
+	conn.Send("HMSET", meta...)
+	b.sendRenewExpiry(conn, channel)
+	if exists {
+		conn.Send("PUBLISH", channel.killID(), resetPayload)
+	}
+	reply, err := conn.Do("EXEC")
+
+	switch {
+	case err != nil:
+		util.CountWithData("RedisBroker.Register.error", 1, "error=%s", err)
+	case reply == nil:
+		// Registered, or purged, meanwhile.
+		util.Count("RedisBroker.Register.conflict")
+		err = ErrExists
+	case exists:
+		// Local reads mustn't wait for the hub to hear of the reset.
+		b.cache.remove(channel)
 	}
 	return
 }
 
 // IsRegistered checks whether a channel name is registered
-func (rr *RedisRegistrar) IsRegistered(channelName string) (registered bool, err error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) IsRegistered(channelName string) (registered bool, err error) {
+	channel := b.channel(channelName)
+	conn := b.pool.Get(channel.id())
 	defer conn.Close()
 
-	channel := channel(channelName)
 	exists, err := redis.Bool(conn.Do("EXISTS", channel.id()))
 	if err != nil {
-		util.CountWithData("RedisRegistrar.IsRegistered.error", 1, "error=%s", err)
+		util.CountWithData("RedisBroker.IsRegistered.error", 1, "error=%s", err)
 	}
 	return exists, err
 }
 
+// NewReader creates a new redis channel reader
+func (b *RedisBroker) NewReader(key string) (io.ReadCloser, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	switch layout, err := b.layout(conn, channel); {
+	case err != nil:
+		return nil, err
+	case layout == StreamLayout:
+		return newStreamReader(b, channel)
+	case layout == StringLayout, layout == SegmentLayout:
+		return newReader(b, channel)
+	}
+	return nil, ErrNotRegistered
+}
+
+// NewWriter creates a new redis channel writer
+func (b *RedisBroker) NewWriter(key string) (io.WriteCloser, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	switch layout, err := b.layout(conn, channel); {
+	case err != nil:
+		return nil, err
+	case layout == StreamLayout:
+		return &streamWriter{b, channel}, nil
+	case layout == StringLayout, layout == SegmentLayout:
+		return &writer{broker: b, channel: channel}, nil
+	}
+	return nil, ErrNotRegistered
+}
+
+// Len returns the length of the data already sent to the channel
+func (b *RedisBroker) Len(key string) (int64, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	if layout, err := b.layout(conn, channel); err != nil {
+		return 0, err
+	} else if layout == StreamLayout {
+		return streamLen(conn, channel)
+	} else if layout == SegmentLayout {
+		return redis.Int64(conn.Do("HGET", channel.id(), "size"))
+	}
+	return redis.Int64(conn.Do("STRLEN", channel.id()))
+}
+
+// Done returns whether the channel is registered and closed
+func (b *RedisBroker) Done(key string) (bool, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", channel.id())
+	conn.Send("EXISTS", channel.doneID())
+	list, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	return list[0] == 1 && list[1] == 1, nil
+}
+
+// RenewExpiry renews the channel expiration
+func (b *RedisBroker) RenewExpiry(key string) error {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	b.sendRenewExpiry(conn, channel)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Meta returns the channel metadata
+func (b *RedisBroker) Meta(key string) (*Metadata, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	return parseMetadata(describeChannel.Do(conn, channel.id(), channel.doneID(), channel.metaID()))
+}
+
+// parseMillis parses a timestamp from the meta hash,
+// returning nil when not set.
+func parseMillis(v string) *time.Time {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return &t
+}
+
 // Get returns a key value
-func Get(key string) ([]byte, error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) Get(key string) ([]byte, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
 	defer conn.Close()
 
-	channel := channel(key)
+	if layout, err := b.layout(conn, channel); err != nil {
+		return nil, err
+	} else if layout == StreamLayout {
+		return streamGet(conn, channel)
+	} else if layout == SegmentLayout {
+		size, err := redis.Int64(conn.Do("HGET", channel.id(), "size"))
+		if err != nil {
+			return nil, err
+		}
+		data, _, _, err := b.getRange(channel, 0, size)
+		return data, err
+	}
 	return redis.Bytes(conn.Do("GET", channel.id()))
 }
+
+// NewSnapshotReader creates a reader of the channel content as of now,
+// fetching it chunk by chunk.
+func (b *RedisBroker) NewSnapshotReader(key string) (io.ReadCloser, error) {
+	channel := b.channel(key)
+	conn := b.pool.Get(channel.id())
+	defer conn.Close()
+
+	layout, err := b.layout(conn, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	switch layout {
+	case StreamLayout:
+		data, err := streamGet(conn, channel)
+		if err != nil {
+			return nil, err
+		}
+		return &bytesSnapshot{bytes.NewReader(data)}, nil
+	case StringLayout, SegmentLayout:
+		size, err := b.Len(key)
+		if err != nil {
+			return nil, err
+		}
+		return &snapshotReader{broker: b, channel: channel, size: size}, nil
+	}
+	return nil, ErrNotRegistered
+}
@@ -1,17 +1,22 @@
 package broker
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
 
-func newRegUUID() (*RedisRegistrar, string) {
-	reg := NewRedisRegistrar()
+func newRegUUID() (*RedisBroker, string) {
 	uuid, _ := util.NewUUID()
 
-	return reg, uuid
+	return redisBroker, uuid
 }
 
 func TestRegisteredIsRegistered(t *testing.T) {
@@ -31,21 +36,364 @@ func TestUnregisteredIsNotRegistered(t *testing.T) {
 }
 
 func TestUnregisteredErrNotRegistered(t *testing.T) {
-	_, uuid := newRegUUID()
+	reg, uuid := newRegUUID()
 
-	_, err := NewReader(uuid)
+	_, err := reg.NewReader(uuid)
 	assert.Equal(t, err, ErrNotRegistered)
 
-	_, err = NewWriter(uuid)
+	_, err = reg.NewWriter(uuid)
 	assert.Equal(t, err, ErrNotRegistered)
 }
 
 func TestRegisteredNoError(t *testing.T) {
 	reg, uuid := newRegUUID()
 	reg.Register(uuid)
-	_, err := NewReader(uuid)
+	_, err := reg.NewReader(uuid)
+	assert.Nil(t, err)
+
+	_, err = reg.NewWriter(uuid)
+	assert.Nil(t, err)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	prefixed, err := NewRedisBroker(&RedisOptions{
+		URL:       os.Getenv("REDIS_URL"),
+		KeyPrefix: "busl-test:",
+	})
+	assert.Nil(t, err)
+
+	uuid, _ := util.NewUUID()
+	prefixed.Register(uuid)
+
+	r, err := prefixed.IsRegistered(uuid)
+	assert.Nil(t, err)
+	assert.True(t, r)
+
+	r, err = redisBroker.IsRegistered(uuid)
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	r, err = redisBroker.IsRegistered("busl-test:" + uuid)
+	assert.Nil(t, err)
+	assert.True(t, r)
+}
+
+func TestDatabaseSelection(t *testing.T) {
+	db, err := NewRedisBroker(&RedisOptions{
+		URL: os.Getenv("REDIS_URL"),
+		DB:  1,
+	})
+	assert.Nil(t, err)
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, db.Register(uuid))
+
+	r, err := db.IsRegistered(uuid)
+	assert.Nil(t, err)
+	assert.True(t, r)
+
+	r, err = redisBroker.IsRegistered(uuid)
+	assert.Nil(t, err)
+	assert.False(t, r)
+}
+
+func TestChannelRetention(t *testing.T) {
+	reg, uuid := newRegUUID()
+	err := reg.RegisterWithOptions(uuid, &ChannelOptions{
+		ChannelExpire: 24 * time.Hour,
+		KeyExpire:     10 * time.Minute,
+	})
+	assert.Nil(t, err)
+
+	conn := reg.pool.Get(uuid)
+	defer conn.Close()
+	ttl := func() int {
+		ttl, _ := redis.Int(conn.Do("TTL", channel(uuid).id()))
+		return ttl
+	}
+	assert.Equal(t, 24*60*60, ttl())
+
+	w, _ := reg.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	assert.Equal(t, 24*60*60, ttl())
+
+	w.Close()
+	assert.Equal(t, 10*60, ttl())
+
+	// Channels registered without options use the broker defaults
+	reg.RegisterWithOptions(uuid, &ChannelOptions{Reset: true})
+	assert.Equal(t, reg.channelExpire(), ttl())
+}
+
+func TestMaxSize(t *testing.T) {
+	for _, b := range []*RedisBroker{redisBroker, streamBroker} {
+		uuid, _ := util.NewUUID()
+		b.RegisterWithOptions(uuid, &ChannelOptions{MaxSize: 8})
+
+		w, _ := b.NewWriter(uuid)
+		n, err := w.Write([]byte("busl"))
+		assert.Nil(t, err)
+		assert.Equal(t, 4, n)
+
+		n, err = w.Write([]byte(" hello"))
+		assert.Equal(t, ErrTooLarge, err)
+		assert.Equal(t, 4, n)
+
+		n, err = w.Write([]byte("!"))
+		assert.Equal(t, ErrTooLarge, err)
+		assert.Equal(t, 0, n)
+
+		data, _ := b.Get(uuid)
+		assert.Equal(t, "busl hel"+TruncatedMarker, string(data))
+
+		done, _ := b.Done(uuid)
+		assert.True(t, done)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	reg, uuid := newRegUUID()
+	_, err := reg.Meta(uuid)
+	assert.Equal(t, ErrNotRegistered, err)
+
+	reg.RegisterWithOptions(uuid, &ChannelOptions{Creator: "ci", ContentType: "text/plain"})
+	meta, err := reg.Meta(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", meta.Creator)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.WithinDuration(t, time.Now(), meta.CreatedAt, time.Second)
+	assert.Nil(t, meta.UpdatedAt)
+	assert.False(t, meta.Closed)
+
+	w, _ := reg.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Close()
+
+	meta, err = reg.Meta(uuid)
 	assert.Nil(t, err)
+	assert.Equal(t, int64(4), meta.Size)
+	assert.NotNil(t, meta.UpdatedAt)
+	assert.NotNil(t, meta.ClosedAt)
+	assert.True(t, meta.Closed)
+	assert.False(t, meta.Truncated)
+}
+
+func TestList(t *testing.T) {
+	prefix, _ := util.NewUUID()
+	for _, key := range []string{"a", "b", "c"} {
+		redisBroker.Register(prefix + "/" + key)
+	}
+	w, _ := redisBroker.NewWriter(prefix + "/b")
+	w.Close()
 
-	_, err = NewWriter(uuid)
+	var keys []string
+	opts := &ListOptions{Prefix: prefix + "/", Count: 1}
+	for {
+		channels, cursor, err := redisBroker.List(opts)
+		assert.Nil(t, err)
+		for _, c := range channels {
+			keys = append(keys, c.Key)
+		}
+		if cursor == "" {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	assert.Len(t, keys, 3)
+
+	closed := true
+	channels, cursor, err := redisBroker.List(&ListOptions{Prefix: prefix + "/", Closed: &closed, Count: 1000})
 	assert.Nil(t, err)
+	assert.Equal(t, "", cursor)
+	assert.Len(t, channels, 1)
+	assert.Equal(t, prefix+"/b", channels[0].Key)
+	assert.True(t, channels[0].Closed)
+
+	channels, _, err = redisBroker.List(&ListOptions{Prefix: prefix + "/", OlderThan: time.Hour, Count: 1000})
+	assert.Nil(t, err)
+	assert.Empty(t, channels)
+
+	_, _, err = redisBroker.List(&ListOptions{Cursor: "invalid"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestPurge(t *testing.T) {
+	reg, uuid := newRegUUID()
+	reg.Register(uuid)
+
+	r, _ := reg.NewReader(uuid)
+	defer r.Close()
+	w, _ := reg.NewWriter(uuid)
+	w.Write([]byte("secret"))
+
+	assert.Nil(t, reg.Purge(uuid, time.Minute))
+	ioutil.ReadAll(r)
+
+	registered, _ := reg.IsRegistered(uuid)
+	assert.False(t, registered)
+	_, err := w.Write([]byte("more"))
+	assert.Equal(t, ErrNotRegistered, err)
+	assert.Equal(t, ErrPurged, reg.Register(uuid))
+
+	conn := reg.pool.Get(reg.channel(uuid).id())
+	defer conn.Close()
+	n, _ := redis.Int(conn.Do("EXISTS", reg.channel(uuid).id(), reg.channel(uuid).metaID()))
+	assert.Equal(t, 0, n)
+
+	// Without grace period, the key can be reused right away.
+	uuid2, _ := util.NewUUID()
+	reg.Register(uuid2)
+	assert.Nil(t, reg.Purge(uuid2, 0))
+	assert.Nil(t, reg.Register(uuid2))
+}
+
+func TestLease(t *testing.T) {
+	reg, uuid := newRegUUID()
+	reg.Register(uuid)
+
+	assert.Nil(t, reg.Lease(uuid, "a", time.Minute))
+	assert.Nil(t, reg.Lease(uuid, "a", time.Minute))
+	assert.Equal(t, ErrLeased, reg.Lease(uuid, "b", time.Minute))
+	assert.Equal(t, ErrLeased, reg.Lease(uuid, "", time.Minute))
+
+	// Only the holder can release it.
+	reg.ReleaseLease(uuid, "b")
+	assert.Equal(t, ErrLeased, reg.Lease(uuid, "b", time.Minute))
+	reg.ReleaseLease(uuid, "a")
+	assert.Nil(t, reg.Lease(uuid, "", time.Minute))
+	assert.Nil(t, reg.Lease(uuid, "b", time.Minute))
+}
+
+func TestRegisterExisting(t *testing.T) {
+	reg, uuid := newRegUUID()
+	assert.Nil(t, reg.Register(uuid))
+	w, _ := reg.NewWriter(uuid)
+	w.Write([]byte("busl"))
+
+	assert.Equal(t, ErrExists, reg.Register(uuid))
+	data, _ := reg.Get(uuid)
+	assert.Equal(t, "busl", string(data))
+
+	meta, _ := reg.Meta(uuid)
+	assert.Equal(t, int64(1), meta.Generation)
+
+	assert.Nil(t, reg.RegisterWithOptions(uuid, &ChannelOptions{Reset: true}))
+	data, _ = reg.Get(uuid)
+	assert.Equal(t, "", string(data))
+
+	meta, _ = reg.Meta(uuid)
+	assert.Equal(t, int64(2), meta.Generation)
+}
+
+func TestRegisterResetReaders(t *testing.T) {
+	reg, uuid := newRegUUID()
+	reg.Register(uuid)
+	w, _ := reg.NewWriter(uuid)
+	w.Write([]byte("busl hello"))
+
+	// A reader keeps the tail of the previous generation cached
+	old, _ := reg.NewReader(uuid)
+	defer old.Close()
+	buf := make([]byte, 64)
+	n, _ := old.Read(buf)
+	assert.Equal(t, "busl hello", string(buf[:n]))
+
+	assert.Nil(t, reg.RegisterWithOptions(uuid, &ChannelOptions{Reset: true}))
+	w, _ = reg.NewWriter(uuid)
+	w.Write([]byte("new"))
+
+	r, _ := reg.NewReader(uuid)
+	defer r.Close()
+	n, _ = r.Read(buf)
+	assert.Equal(t, "new", string(buf[:n]))
+
+	// Readers of the previous generation stop
+	_, err := old.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSealed(t *testing.T) {
+	for _, b := range []*RedisBroker{redisBroker, streamBroker, segmentBroker} {
+		uuid, _ := util.NewUUID()
+		b.Register(uuid)
+		w, _ := b.NewWriter(uuid)
+		w.Write([]byte("busl"))
+		w.Close()
+
+		n, err := w.Write([]byte(" hello"))
+		assert.Equal(t, ErrClosed, err)
+		assert.Equal(t, 0, n)
+
+		done, _ := b.Done(uuid)
+		assert.True(t, done)
+		data, _ := b.Get(uuid)
+		assert.Equal(t, "busl", string(data))
+		meta, _ := b.Meta(uuid)
+		assert.True(t, meta.Sealed)
+
+		// Reopenable channels keep the legacy behavior.
+		uuid, _ = util.NewUUID()
+		b.RegisterWithOptions(uuid, &ChannelOptions{Reopenable: true})
+		w, _ = b.NewWriter(uuid)
+		w.Close()
+		_, err = w.Write([]byte("busl"))
+		assert.Nil(t, err)
+		done, _ = b.Done(uuid)
+		assert.False(t, done)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	for _, b := range []*RedisBroker{redisBroker, streamBroker, segmentBroker} {
+		uuid, _ := util.NewUUID()
+		b.Register(uuid)
+		w, _ := b.NewWriter(uuid)
+		w.Write([]byte("busl"))
+		w.Write([]byte(" hello"))
+
+		// Writes within TimeResolution share a mark
+		index, err := b.Index(uuid)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(10), index.Size)
+		assert.Len(t, index.Times, 1)
+		assert.Equal(t, int64(0), index.Times[0].Offset)
+		assert.WithinDuration(t, time.Now(), index.Times[0].Time, time.Second)
+
+		o, err := b.TimeOffset(uuid, time.Now().Add(-time.Hour))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), o)
+		o, err = b.TimeOffset(uuid, time.Now().Add(time.Hour))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(10), o)
+
+		// Resetting the channel drops its index
+		b.RegisterWithOptions(uuid, &ChannelOptions{Reset: true})
+		index, _ = b.Index(uuid)
+		assert.Empty(t, index.Times)
+	}
+}
+
+func TestLineIndex(t *testing.T) {
+	for _, b := range []*RedisBroker{redisBroker, streamBroker, segmentBroker} {
+		uuid, _ := util.NewUUID()
+		b.Register(uuid)
+		w, _ := b.NewWriter(uuid)
+		for i := 0; i < 5; i++ {
+			w.Write(bytes.Repeat([]byte("x\n"), 500))
+		}
+		w.Write([]byte("x"))
+
+		index, err := b.Index(uuid)
+		assert.Nil(t, err)
+		assert.Equal(t, []LineMark{{1001, 2000}, {2001, 4000}}, index.Lines)
+		assert.Equal(t, int64(2500), index.LineCount)
+
+		offset, marked, err := b.LineOffset(uuid, 1500)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2000), offset)
+		assert.Equal(t, int64(1001), marked)
+
+		meta, _ := b.Meta(uuid)
+		assert.Equal(t, int64(2500), meta.Lines)
+	}
 }
@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"io"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// DefaultSegmentSize is the size of the keys a channel is split
+	// into with the segment layout.
+	DefaultSegmentSize = 8 << 20
+
+	// DefaultCompressedSegmentSize is the segment size used by default
+	// with compression, reading any byte of a compressed segment
+	// inflating it whole.
+	DefaultCompressedSegmentSize = 1 << 20
+
+	snapshotChunk = 1 << 20 // bytes fetched at once by snapshot readers
+)
+
+// With the segment layout, the channel id key is a hash indexing
+// the channel data split into fixed size segment keys:
+//
+//   size          total size of the channel
+//   segments      number of segment keys
+//   segment_size  size of every segment key but the last one
+//   compressed    number of leading segments stored compressed, only
+//                 set for channels registered with compression
+//
+// Compressed channels have their segments compressed as they fill
+// up, and the last one when the channel is closed. That one is
+// stored back raw if the channel gets reopened.
+//
+// Segment keys are named after the id key so they share its hash
+// tag in cluster mode.
+//
+// getRange returns the data as a list of parts: raw segments are
+// sliced in place while compressed ones are returned whole, along
+// with the offset and length to slice once inflated.
+const luaSegments = `
+local function segment(index, n)
+  return string.sub(index, 1, -4) .. ':segment:' .. n
+end
+
+local function isSegmented(index)
+  return redis.call('TYPE', index).ok == 'hash'
+end
+
+local function expireSegments(index, ttl)
+  if not isSegmented(index) then
+    return
+  end
+  local count = tonumber(redis.call('HGET', index, 'segments')) or 0
+  for n = 0, count - 1 do
+    redis.call('EXPIRE', segment(index, n), ttl)
+  end
+end
+
+local function deleteSegments(index)
+  if not isSegmented(index) then
+    return
+  end
+  local count = tonumber(redis.call('HGET', index, 'segments')) or 0
+  for n = 0, count - 1 do
+    redis.call('DEL', segment(index, n))
+  end
+end
+
+local function channelSize(index)
+  if isSegmented(index) then
+    return tonumber(redis.call('HGET', index, 'size'))
+  end
+  return redis.call('STRLEN', index)
+end
+
+local function appendSegments(index, data)
+  local size = tonumber(redis.call('HGET', index, 'size'))
+  local segmentSize = tonumber(redis.call('HGET', index, 'segment_size'))
+  local pos = 1
+  while pos <= #data do
+    local n = math.floor(size / segmentSize)
+    local room = segmentSize - size % segmentSize
+    local chunk = string.sub(data, pos, pos + room - 1)
+    redis.call('APPEND', segment(index, n), chunk)
+    size = size + #chunk
+    pos = pos + #chunk
+  end
+  redis.call('HSET', index, 'size', size)
+  redis.call('HSET', index, 'segments', math.ceil(size / segmentSize))
+  return size
+end
+
+local function compressibleSegment(index, partial)
+  if not isSegmented(index) then
+    return nil
+  end
+  local compressed = tonumber(redis.call('HGET', index, 'compressed'))
+  if not compressed then
+    return nil
+  end
+  local size = tonumber(redis.call('HGET', index, 'size'))
+  local segmentSize = tonumber(redis.call('HGET', index, 'segment_size'))
+  if partial then
+    if compressed * segmentSize >= size then
+      return nil
+    end
+  elseif (compressed + 1) * segmentSize > size then
+    return nil
+  end
+  return compressed
+end
+
+local function compressedTail(index)
+  if not isSegmented(index) then
+    return false
+  end
+  local compressed = tonumber(redis.call('HGET', index, 'compressed')) or 0
+  local size = tonumber(redis.call('HGET', index, 'size'))
+  local segmentSize = tonumber(redis.call('HGET', index, 'segment_size'))
+  return compressed * segmentSize > size
+end
+
+local function appendData(index, data)
+  if isSegmented(index) then
+    return appendSegments(index, data)
+  end
+  return redis.call('APPEND', index, data)
+end
+
+local function getRange(index, first, last)
+  if not isSegmented(index) then
+    return {redis.call('GETRANGE', index, first, last)}
+  end
+
+  local size = tonumber(redis.call('HGET', index, 'size'))
+  local segmentSize = tonumber(redis.call('HGET', index, 'segment_size'))
+  local compressed = tonumber(redis.call('HGET', index, 'compressed')) or 0
+  last = math.min(last, size - 1)
+
+  local parts = {}
+  while first <= last do
+    local n = math.floor(first / segmentSize)
+    local stop = math.min(last, (n + 1) * segmentSize - 1)
+    if n < compressed then
+      parts[#parts + 1] = {redis.call('GET', segment(index, n)), first - n * segmentSize, stop - first + 1}
+    else
+      parts[#parts + 1] = redis.call('GETRANGE', segment(index, n), first - n * segmentSize, stop - n * segmentSize)
+    end
+    first = stop + 1
+  end
+  return parts
+end
+`
+
+// resetSegments (re)creates the index of a segmented channel,
+// deleting the segments of any previous registration.
+var resetSegments = redis.NewScript(1, luaSegments+`
+deleteSegments(KEYS[1])
+redis.call('DEL', KEYS[1])
+redis.call('HMSET', KEYS[1], 'size', 0, 'segments', 0, 'segment_size', ARGV[1])
+if ARGV[2] == '1' then
+  redis.call('HSET', KEYS[1], 'compressed', 0)
+end
+`)
+
+// readRange reads the data between two offsets, both included, along
+// with the channel size and whether it's done, renewing its expiry.
+var readRange = redis.NewScript(3, luaIndex+luaSegments+`
+local first, last = tonumber(ARGV[1]), tonumber(ARGV[2])
+local parts = {}
+if first <= last then
+  parts = getRange(KEYS[1], first, last)
+end
+local size = channelSize(KEYS[1])
+local done = redis.call('EXISTS', KEYS[2])
+
+local ttl = tonumber(redis.call('HGET', KEYS[3], 'channel_expire')) or tonumber(ARGV[3])
+redis.call('EXPIRE', KEYS[1], ttl)
+redis.call('EXPIRE', KEYS[3], ttl)
+expireSegments(KEYS[1], ttl)
+expireIndex(KEYS[1], ttl)
+return {parts, size, done}
+`)
+
+// snapshotReader reads a channel up to the size it had when opened,
+// holding a single chunk in memory at a time. Stream layout channels
+// are read at once into data.
+type snapshotReader struct {
+	broker  *RedisBroker
+	channel channel
+	size    int64
+	offset  int64
+	data    []byte
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if r.broker == nil || r.offset >= r.size {
+			return 0, io.EOF
+		}
+
+		end := r.offset + snapshotChunk
+		if end > r.size {
+			end = r.size
+		}
+		data, _, _, err := r.broker.getRange(r.channel, r.offset, end)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			return 0, io.ErrUnexpectedEOF // expired meanwhile
+		}
+		r.data = data
+		r.offset += int64(len(data))
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Len returns the number of bytes left to read.
+func (r *snapshotReader) Len() int {
+	if r.offset > r.size {
+		return 0
+	}
+	return int(r.size - r.offset + int64(len(r.data)))
+}
+
+// Seek sets the offset of the next read within the snapshot.
+func (r *snapshotReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset - int64(len(r.data))
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	r.offset, r.data = offset, nil
+	return offset, nil
+}
+
+func (r *snapshotReader) Close() error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var segmentBroker, _ = NewRedisBroker(&RedisOptions{
+	URL:         os.Getenv("REDIS_URL"),
+	Layout:      SegmentLayout,
+	SegmentSize: 4,
+})
+
+func setupSegments() string {
+	uuid, _ := util.NewUUID()
+	segmentBroker.Register(uuid)
+
+	return uuid
+}
+
+func Example_segment_pub_sub() {
+	uuid := setupSegments()
+
+	r, _ := segmentBroker.NewReader(uuid)
+	defer r.Close()
+
+	done := make(chan bool)
+	go func() {
+		io.Copy(os.Stdout, r)
+		done <- true
+	}()
+
+	w, _ := segmentBroker.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	<-done
+
+	//Output:
+	// busl hello world
+}
+
+func TestSegmentKeys(t *testing.T) {
+	uuid := setupSegments()
+
+	w, _ := segmentBroker.NewWriter(uuid)
+	w.Write([]byte("busl hello world"))
+	w.Write([]byte("!"))
+
+	conn := segmentBroker.pool.Get(uuid)
+	defer conn.Close()
+
+	segments, err := redis.Strings(conn.Do("KEYS", uuid+":segment:*"))
+	assert.Nil(t, err)
+	assert.Len(t, segments, 5)
+
+	last, _ := redis.String(conn.Do("GET", uuid+":segment:4"))
+	assert.Equal(t, "!", last)
+
+	l, err := segmentBroker.Len(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17), l)
+
+	// Ranges spanning several segments
+	data, size, _, err := segmentBroker.getRange(channel(uuid), 3, 14)
+	assert.Nil(t, err)
+	assert.Equal(t, "l hello wor", string(data))
+	assert.Equal(t, int64(17), size)
+
+	// Resetting the channel drops the previous segments
+	segmentBroker.RegisterWithOptions(uuid, &ChannelOptions{Reset: true})
+	segments, _ = redis.Strings(conn.Do("KEYS", uuid+":segment:*"))
+	assert.Empty(t, segments)
+}
+
+func TestSegmentSnapshotSeek(t *testing.T) {
+	uuid := setupSegments()
+
+	w, _ := segmentBroker.NewWriter(uuid)
+	w.Write([]byte("busl hello world"))
+
+	r, err := segmentBroker.NewSnapshotReader(uuid)
+	assert.Nil(t, err)
+	defer r.Close()
+
+	r.(io.Seeker).Seek(5, io.SeekStart)
+	assert.Equal(t, 11, r.(*snapshotReader).Len())
+
+	buf := make([]byte, 5)
+	n, _ := r.Read(buf)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	offset, _ := r.(io.Seeker).Seek(1, io.SeekCurrent)
+	assert.Equal(t, int64(11), offset)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "world", string(data))
+
+	r.(io.Seeker).Seek(100, io.SeekStart)
+	assert.Equal(t, 0, r.(*snapshotReader).Len())
+}
+
+func TestSegmentSnapshot(t *testing.T) {
+	uuid := setupSegments()
+
+	w, _ := segmentBroker.NewWriter(uuid)
+	w.Write([]byte("busl hello"))
+
+	r, err := segmentBroker.NewSnapshotReader(uuid)
+	assert.Nil(t, err)
+	defer r.Close()
+	assert.Equal(t, 10, r.(*snapshotReader).Len())
+
+	// Writes after the snapshot aren't part of it
+	w.Write([]byte(" world"))
+
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "busl hello", string(data))
+
+	data, err = segmentBroker.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "busl hello world", string(data))
+}
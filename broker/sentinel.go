@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// ErrNoMaster is returned when none of the sentinels
+// knows the address of the master.
+var ErrNoMaster = errors.New("No redis master found by the sentinels")
+
+const sentinelTimeout = time.Second
+
+// sentinel discovers the current master through redis sentinels.
+// The master is looked up again for every new connection, so
+// a failover is followed as soon as the pool dials again.
+type sentinel struct {
+	addrs []string
+	name  string
+	dial  func(addr string) (redis.Conn, error)
+}
+
+func newSentinel(addrs []string, master string, dial func(string) (redis.Conn, error)) *sentinel {
+	return &sentinel{addrs: addrs, name: master, dial: dial}
+}
+
+func (s *sentinel) master() (string, error) {
+	for _, addr := range s.addrs {
+		master, err := s.askMaster(addr)
+		if err == nil {
+			return master, nil
+		}
+		util.CountWithData("redis.sentinel.error", 1, "sentinel=%s error=%s", addr, err)
+	}
+	return "", ErrNoMaster
+}
+
+func (s *sentinel) askMaster(addr string) (string, error) {
+	c, err := s.dial(addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.name))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", ErrNoMaster
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+var errNotMaster = errors.New("Connected redis node is not a master")
+
+// checkMaster verifies that c is still connected to a master.
+func checkMaster(c redis.Conn) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	if len(reply) == 0 {
+		return errNotMaster
+	}
+	if role, _ := redis.String(reply[0], nil); role != "master" {
+		util.Count("redis.sentinel.demoted")
+		return errNotMaster
+	}
+	return nil
+}
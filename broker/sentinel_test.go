@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis answers every command with the canned reply registered
+// for its name, formatted in the redis protocol.
+func fakeRedis(t *testing.T, replies map[string]string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					args := make([]string, n)
+					for i := range args {
+						var l int
+						fmt.Fscanf(r, "$%d\r\n", &l)
+						buf := make([]byte, l+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						args[i] = string(buf[:l])
+					}
+					fmt.Fprint(c, replies[strings.ToUpper(args[0])])
+				}
+			}(c)
+		}
+	}()
+	return l
+}
+
+func TestSentinelMaster(t *testing.T) {
+	l := fakeRedis(t, map[string]string{
+		"SENTINEL": "*2\r\n$8\r\n10.0.0.1\r\n$4\r\n6379\r\n",
+	})
+	defer l.Close()
+
+	s := newSentinel([]string{"127.0.0.1:1", l.Addr().String()}, "mymaster", dialPlain)
+	master, err := s.master()
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:6379", master)
+}
+
+func TestSentinelNoMaster(t *testing.T) {
+	l := fakeRedis(t, map[string]string{
+		"SENTINEL": "*-1\r\n",
+	})
+	defer l.Close()
+
+	s := newSentinel([]string{l.Addr().String()}, "mymaster", dialPlain)
+	_, err := s.master()
+	assert.Equal(t, ErrNoMaster, err)
+}
+
+func dialPlain(addr string) (redis.Conn, error) {
+	return redis.Dial("tcp", addr)
+}
+
+func TestSentinelPassword(t *testing.T) {
+	l := fakeRedis(t, map[string]string{
+		"AUTH":     "-WRONGPASS invalid password\r\n",
+		"SENTINEL": "*2\r\n$8\r\n10.0.0.1\r\n$4\r\n6379\r\n",
+	})
+	defer l.Close()
+
+	// Sentinels are only authenticated given their password
+	for password, expected := range map[string]error{"": nil, "secret": ErrNoMaster} {
+		opts := &RedisOptions{
+			URL:              "redis://:nodes@localhost:6379",
+			SentinelAddrs:    []string{l.Addr().String()},
+			SentinelMaster:   "mymaster",
+			SentinelPassword: password,
+		}
+		server, err := opts.parse()
+		assert.Nil(t, err)
+
+		_, err = newPool(server, opts).sentinel.master()
+		assert.Equal(t, expected, err, password)
+	}
+}
+
+func TestCheckMaster(t *testing.T) {
+	for role, expected := range map[string]error{"master": nil, "slave": errNotMaster} {
+		l := fakeRedis(t, map[string]string{
+			"ROLE": fmt.Sprintf("*1\r\n$%d\r\n%s\r\n", len(role), role),
+		})
+
+		c, err := redis.Dial("tcp", l.Addr().String())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, checkMaster(c))
+
+		c.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,471 @@
+package broker
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// Layout selects how channel data is stored in redis.
+type Layout string
+
+// Supported layouts
+const (
+	// StringLayout appends every write onto a single string key
+	// and notifies subscribers over pub/sub.
+	StringLayout Layout = "string"
+
+	// StreamLayout adds every write as an entry of a redis stream,
+	// followed by subscribers with a blocking XREAD.
+	StreamLayout Layout = "stream"
+
+	// SegmentLayout splits the channel data into fixed size string
+	// keys, lifting the size limit of a single string.
+	SegmentLayout Layout = "segment"
+)
+
+// How long a stream reader blocks on XREAD before checking
+// whether it has been closed.
+const streamBlock = 5000 // milliseconds
+
+// streamAppend adds an entry to a stream layout channel. Every entry
+// carries the cumulative byte offset of the channel once its data is
+// appended, which translates byte offsets into entries. Entries with
+// data are indexed by that offset, so readers find where to start.
+//
+// Closing the channel adds an entry with no data and a done field,
+// waking up any blocked reader. Other writes are given a time: they
+// reopen the channel, and their time and lines are indexed.
+//
+// Writes past the size limit are truncated as with the string layout.
+// Nothing is written to a sealed channel once closed, nor to one which
+// is gone, having expired or been purged, so it isn't created again.
+//
+// The reply holds, in order: the offset, how much of the data was
+// written, then flags telling whether the channel got truncated, is
+// sealed, and is gone.
+var streamAppend = redis.NewScript(3, luaIndex+`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return {0, 0, 0, 0, 1}
+end
+
+local offset = 0
+local last = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+if last[1] then
+  local fields = last[1][2]
+  for i = 1, #fields, 2 do
+    if fields[i] == 'offset' then
+      offset = tonumber(fields[i + 1])
+    end
+  end
+end
+
+local data = ARGV[1]
+local written, truncated = #data, 0
+if #data > 0 and redis.call('HEXISTS', KEYS[2], 'truncated') == 1 then
+  return {offset, 0, 1, 0, 0}
+end
+
+if ARGV[2] ~= '1' and ARGV[5] ~= '' then
+  if redis.call('EXISTS', KEYS[3]) == 1 and redis.call('HEXISTS', KEYS[2], 'sealed') == 1 then
+    return {offset, 0, 0, 1, 0}
+  end
+  redis.call('DEL', KEYS[3])
+  redis.call('HSET', KEYS[2], 'updated_at', ARGV[5])
+  redis.call('HDEL', KEYS[2], 'closed_at')
+end
+
+local max = tonumber(redis.call('HGET', KEYS[2], 'max_size')) or tonumber(ARGV[3])
+if max > 0 and #data > math.max(max - offset, 0) then
+  written, truncated = math.max(max - offset, 0), 1
+  data = string.sub(data, 1, written) .. ARGV[4]
+  redis.call('HSET', KEYS[2], 'truncated', 1)
+end
+
+if #data > 0 and ARGV[5] ~= '' then
+  markTime(KEYS[1], offset, ARGV[5])
+  markLines(KEYS[1], KEYS[2], offset, data)
+end
+offset = offset + string.len(data)
+local id
+if ARGV[2] == '1' then
+  id = redis.call('XADD', KEYS[1], '*', 'offset', offset, 'data', data, 'done', 1)
+else
+  id = redis.call('XADD', KEYS[1], '*', 'offset', offset, 'data', data)
+end
+if #data > 0 then
+  redis.call('ZADD', entries(KEYS[1]), offset, id)
+end
+return {offset, written, truncated, 0, 0}
+`)
+
+type streamEntry struct {
+	id     string
+	offset int64 // cumulative offset at the end of data
+	data   []byte
+	done   bool
+}
+
+// parseStreamEntries parses the entries of an XRANGE reply,
+// or of a single stream of an XREAD reply.
+func parseStreamEntries(reply interface{}, err error) ([]streamEntry, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(values))
+	for _, v := range values {
+		e, err := redis.Values(v, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry streamEntry
+		if entry.id, err = redis.String(e[0], nil); err != nil {
+			return nil, err
+		}
+
+		fields, err := redis.Values(e[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := redis.String(fields[i], nil)
+			switch name {
+			case "offset":
+				entry.offset, err = redis.Int64(fields[i+1], nil)
+			case "data":
+				entry.data, err = redis.Bytes(fields[i+1], nil)
+			case "done":
+				entry.done = true
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func streamLen(conn redis.Conn, c channel) (int64, error) {
+	entries, err := parseStreamEntries(conn.Do("XREVRANGE", c.id(), "+", "-", "COUNT", 1))
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	return entries[0].offset, nil
+}
+
+func streamGet(conn redis.Conn, c channel) ([]byte, error) {
+	entries, err := parseStreamEntries(conn.Do("XRANGE", c.id(), "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		buf = append(buf, e.data...)
+	}
+	return buf, nil
+}
+
+func (b *RedisBroker) sendStreamAppend(conn redis.Conn, c channel, p []byte, done bool, now string) error {
+	return streamAppend.Send(conn, c.id(), c.metaID(), c.doneID(), p, done, b.opts.MaxSize, TruncatedMarker, now)
+}
+
+type streamWriter struct {
+	broker  *RedisBroker
+	channel channel
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	conn := w.broker.pool.Get(w.channel.id())
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	w.broker.sendStreamAppend(conn, w.channel, p, false, strconv.FormatInt(millis(time.Now()), 10))
+	w.broker.sendRenewExpiry(conn, w.channel)
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	reply, err := redis.Ints(list[0], nil)
+	if err != nil {
+		return 0, err
+	}
+	if reply[4] == 1 {
+		return 0, ErrNotRegistered
+	}
+	if reply[3] == 1 {
+		return 0, ErrClosed
+	}
+	if reply[2] == 1 {
+		util.CountWithData("RedisBroker.truncated", 1, "channel=%s", w.channel)
+		w.Close()
+		return reply[1], ErrTooLarge
+	}
+	return reply[1], nil
+}
+
+func (w *streamWriter) Close() error {
+	conn := w.broker.pool.Get(w.channel.id())
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	w.broker.sendStreamAppend(conn, w.channel, []byte{}, true, "")
+	conn.Send("SET", w.channel.doneID(), []byte{1})
+	conn.Send("HSET", w.channel.metaID(), metaClosedAt, millis(time.Now()))
+	w.broker.sendCloseExpiry(conn, w.channel)
+	conn.Send("PUBLISH", w.channel.killID(), 1)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+type streamReader struct {
+	broker  *RedisBroker
+	channel channel
+	conn    Conn          // dedicated to the blocking XREAD
+	sub     *subscription // notified when the channel is killed
+	offset  int64         // byte offset of the next byte to return
+	lastID  string        // last entry read from the stream
+	pending []byte        // data read but not yet returned
+	done    bool
+	closed  bool
+	reading bool // whether conn is blocked in XREAD
+	mutex   *sync.Mutex
+}
+
+func newStreamReader(b *RedisBroker, channel channel) (*streamReader, error) {
+	sub, err := b.hub.subscribe(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		broker:  b,
+		channel: channel,
+		conn:    b.pool.GetBlocking(channel.id()),
+		sub:     sub,
+		lastID:  "0",
+		mutex:   &sync.Mutex{},
+	}, nil
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case 0:
+		r.offset = offset
+	case 1:
+		r.offset += offset
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	return r.offset, nil
+}
+
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	if r.isClosed() {
+		return 0, io.EOF
+	}
+
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		err = r.next()
+		if r.isClosed() {
+			return 0, io.EOF
+		}
+		if err != nil {
+			util.CountWithData("RedisBroker.stream.ReadError", 1, "err=%s", err)
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) == 0 && r.done {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// locate skips the entries ending up to the offset, looking up
+// the last of them in the entries index.
+func (r *streamReader) locate() error {
+	conn := r.broker.pool.Get(r.channel.id())
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE", r.channel.entriesID(),
+		r.offset, "-inf", "LIMIT", 0, 1))
+	if err == nil && len(ids) > 0 {
+		r.lastID = ids[0]
+	}
+	return err
+}
+
+type streamRead struct {
+	reply []interface{}
+	err   error
+}
+
+// next blocks until new entries are added to the stream, then
+// buffers their data from the current offset onwards. Purged
+// channels get no entry, their readers are kicked over the kill
+// channel instead, leaving XREAD to release conn once it returns.
+func (r *streamReader) next() error {
+	if r.lastID == "0" && r.offset > 0 {
+		if err := r.locate(); err != nil {
+			return err
+		}
+	}
+	if !r.begin() {
+		return nil
+	}
+
+	reads := make(chan streamRead, 1)
+	go func() {
+		reply, err := redis.Values(r.conn.Do("XREAD", "COUNT", 100, "BLOCK", streamBlock,
+			"STREAMS", r.channel.id(), r.lastID))
+		r.end()
+		reads <- streamRead{reply, err}
+	}()
+
+	for {
+		select {
+		case read := <-reads:
+			return r.add(read.reply, read.err)
+		case <-r.sub.notify:
+			if atomic.LoadInt32(&r.sub.killed) == 0 {
+				continue
+			}
+			if err := r.checkGone(); err != nil || r.done {
+				return err
+			}
+		}
+	}
+}
+
+// add buffers the data of the entries returned by XREAD.
+func (r *streamReader) add(reply []interface{}, err error) error {
+	if err == redis.ErrNil {
+		return r.checkGone()
+	}
+	if err != nil {
+		return err
+	}
+
+	stream, err := redis.Values(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	entries, err := parseStreamEntries(stream[1], nil)
+	if err != nil {
+		return err
+	}
+
+	var done bool
+	for _, e := range entries {
+		r.lastID = e.id
+		if e.offset > r.offset {
+			skip := int64(len(e.data)) - (e.offset - r.offset)
+			if skip < 0 {
+				skip = 0
+			}
+			r.pending = append(r.pending, e.data[skip:]...)
+			r.offset = e.offset
+		}
+		done = e.done
+	}
+
+	conn := r.broker.pool.Get(r.channel.id())
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", r.channel.doneID())
+	r.broker.sendRenewExpiry(conn, r.channel)
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	// A write after the close entry reopens the channel,
+	// so the done key has the final say.
+	if done {
+		r.done, err = redis.Bool(list[0], nil)
+		if r.done {
+			util.Count("RedisBroker.stream.channelDone")
+		}
+	}
+	return err
+}
+
+// checkGone stops following channels which were purged or expired
+// while nothing was added to them.
+func (r *streamReader) checkGone() error {
+	conn := r.broker.pool.Get(r.channel.id())
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", r.channel.id()))
+	if err == nil && !exists {
+		util.Count("RedisBroker.stream.channelGone")
+		r.done = true
+	}
+	return err
+}
+
+func (r *streamReader) isClosed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closed
+}
+
+// begin marks conn as in use by a read, unless the reader is closed.
+func (r *streamReader) begin() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.reading = !r.closed
+	return r.reading
+}
+
+// end marks the read done, releasing conn when the reader was closed
+// meanwhile.
+func (r *streamReader) end() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.reading = false
+	if r.closed {
+		r.conn.Close()
+	}
+}
+
+// Close releases conn, once XREAD returned when it's blocked in a
+// read: a pooled connection can't be handed out with a pending reply.
+func (r *streamReader) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.broker.hub.unsubscribe(r.sub)
+	if r.reading {
+		return nil
+	}
+	return r.conn.Close()
+}
@@ -0,0 +1,201 @@
+package broker
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var streamBroker, _ = NewRedisBroker(&RedisOptions{
+	URL:    os.Getenv("REDIS_URL"),
+	Layout: StreamLayout,
+})
+
+func setupStream() string {
+	uuid, _ := util.NewUUID()
+	streamBroker.Register(uuid)
+
+	return uuid
+}
+
+func Example_stream_pub_sub() {
+	uuid := setupStream()
+
+	r, _ := streamBroker.NewReader(uuid)
+	defer r.Close()
+
+	done := make(chan bool)
+	go func() {
+		io.Copy(os.Stdout, r)
+		done <- true
+	}()
+
+	w, _ := streamBroker.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	<-done
+
+	//Output:
+	// busl hello world
+}
+
+func TestStreamSeek(t *testing.T) {
+	uuid := setupStream()
+
+	w, _ := streamBroker.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	for offset, expected := range map[int64]string{0: "busl hello world", 6: "ello world", 10: " world", 16: ""} {
+		r, _ := streamBroker.NewReader(uuid)
+		r.(io.Seeker).Seek(offset, 0)
+
+		buf, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(buf))
+		r.Close()
+	}
+}
+
+func TestStreamLocate(t *testing.T) {
+	uuid := setupStream()
+
+	w, _ := streamBroker.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	conn := streamBroker.pool.Get(uuid)
+	defer conn.Close()
+	entries, _ := parseStreamEntries(conn.Do("XRANGE", channel(uuid).id(), "-", "+"))
+
+	// Reading from an offset skips the entries before it
+	for offset, expected := range map[int64]string{3: "0", 4: entries[1].id, 10: entries[2].id, 12: entries[2].id} {
+		r, _ := streamBroker.NewReader(uuid)
+		r.(io.Seeker).Seek(offset, 0)
+		assert.Nil(t, r.(*streamReader).locate())
+		assert.Equal(t, expected, r.(*streamReader).lastID, offset)
+		r.Close()
+	}
+
+	r, _ := streamBroker.NewReader(uuid)
+	defer r.Close()
+	r.(io.Seeker).Seek(100, 0)
+	buf, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Empty(t, buf)
+}
+
+func TestStreamLenAndGet(t *testing.T) {
+	uuid := setupStream()
+
+	l, err := streamBroker.Len(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), l)
+
+	w, _ := streamBroker.NewWriter(uuid)
+	w.Write(bytes.Repeat([]byte("0"), 4096))
+	w.Write([]byte("A"))
+
+	l, err = streamBroker.Len(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4097), l)
+
+	buf, err := streamBroker.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, append(bytes.Repeat([]byte("0"), 4096), 'A'), buf)
+}
+
+func TestStreamLayoutDetection(t *testing.T) {
+	// Channels registered with the string layout are still
+	// readable by a broker configured with the stream layout.
+	uuid := setup()
+
+	w, err := streamBroker.NewWriter(uuid)
+	assert.Nil(t, err)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	r, err := streamBroker.NewReader(uuid)
+	assert.Nil(t, err)
+	defer r.Close()
+
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestStreamCloseWhileReading(t *testing.T) {
+	uuid := setupStream()
+
+	r, _ := streamBroker.NewReader(uuid)
+	read := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 8))
+		read <- err
+	}()
+
+	// The blocked read returns once XREAD does, then releases conn
+	time.Sleep(50 * time.Millisecond)
+	r.Close()
+	w, _ := streamBroker.NewWriter(uuid)
+	w.Write([]byte("busl"))
+
+	assert.Equal(t, io.EOF, <-read)
+	_, err := r.Read(make([]byte, 8))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestStreamPurge(t *testing.T) {
+	uuid := setupStream()
+
+	w, _ := streamBroker.NewWriter(uuid)
+	w.Write([]byte("secret"))
+	assert.Nil(t, streamBroker.Lease(uuid, "a", time.Minute))
+
+	assert.Nil(t, streamBroker.Purge(uuid, time.Minute))
+
+	// Publishers mid-upload don't create the stream again
+	_, err := w.Write([]byte("more"))
+	assert.Equal(t, ErrNotRegistered, err)
+
+	conn := streamBroker.pool.Get(uuid)
+	defer conn.Close()
+	n, _ := redis.Int(conn.Do("EXISTS", channel(uuid).id(), channel(uuid).leaseID()))
+	assert.Equal(t, 0, n)
+}
+
+func TestStreamPurgeKicksReaders(t *testing.T) {
+	uuid := setupStream()
+
+	r, _ := streamBroker.NewReader(uuid)
+	defer r.Close()
+	read := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 8))
+		read <- err
+	}()
+
+	// Blocked readers don't wait for XREAD to time out
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, streamBroker.Purge(uuid, 0))
+
+	select {
+	case err := <-read:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("reader not kicked")
+	}
+}
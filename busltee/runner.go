@@ -12,6 +12,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/heroku/busl/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -27,6 +28,7 @@ type Config struct {
 	Args          []string
 	LogFile       string
 	RequestID     string
+	LeaseToken    string // identifies the publisher across reconnections
 	Verbose       bool
 }
 
@@ -35,6 +37,10 @@ func Run(url string, args []string, conf *Config) (exitCode int) {
 	defer monitor("busltee.busltee", time.Now())
 	setupLog(conf)
 
+	if conf.LeaseToken == "" {
+		conf.LeaseToken, _ = util.NewUUID()
+	}
+
 	reader, writer := io.Pipe()
 	done := post(url, reader, conf)
 
@@ -113,6 +119,11 @@ func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
 	if conf.RequestID != "" {
 		req.Header.Set("Request-Id", conf.RequestID)
 	}
+	// Holding the stream publisher lease keeps other publishers out,
+	// while letting us reclaim it when reconnecting.
+	if conf.LeaseToken != "" {
+		req.Header.Set("X-Lease-Token", conf.LeaseToken)
+	}
 
 	if err != nil {
 		return err
@@ -143,6 +154,7 @@ func newTransport(conf *Config) http.RoundTripper {
 		Transport:     tr,
 		MaxRetries:    uint(conf.StreamRetry),
 		SleepDuration: conf.SleepDuration,
+		Resume:        true,
 	}
 }
 
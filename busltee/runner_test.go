@@ -131,7 +131,7 @@ func TestRunKillsProcessGroup(t *testing.T) {
 	select {
 	case err := <-ch:
 		if err != nil {
-			t.Fatalf(err.Error())
+			t.Fatal(err)
 		}
 	case <-time.After(10 * time.Second):
 		t.Fatalf("timed out waiting")
@@ -181,3 +181,29 @@ func fauxBusl() (*httptest.Server, chan []byte) {
 	server := httptest.NewServer(mux)
 	return server, post
 }
+
+func TestLeaseToken(t *testing.T) {
+	post := make(chan string, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		post <- r.Header.Get("X-Lease-Token")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	config := &Config{}
+	if code := Run(server.URL, []string{"printf", "hello"}, config); code != 0 {
+		t.Fatalf("Expected exit code to be 0, got %d", code)
+	}
+
+	select {
+	case result := <-post:
+		if config.LeaseToken == "" || result != config.LeaseToken {
+			t.Fatalf("Expected lease token to be `%s`, got %s", config.LeaseToken, result)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("POST channel got no response")
+	}
+}
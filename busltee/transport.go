@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,6 +21,10 @@ type Transport struct {
 	Transport     http.RoundTripper
 	SleepDuration time.Duration
 
+	// Resume makes retries only send what the server is missing,
+	// as told by a HEAD request, from an Upload-Offset header.
+	Resume bool
+
 	bufferName string
 	cond       *sync.Cond
 	mutex      *sync.Mutex
@@ -72,18 +77,30 @@ func (t *Transport) tries(req *http.Request) (*http.Response, error) {
 
 func (t *Transport) runRequest(req *http.Request) (*http.Response, error) {
 	var statusCode int
-	bodyReader, err := t.newBodyReader()
+	var offset int64
+	if t.Resume && t.retries > 0 {
+		offset = t.committed(req)
+	}
+
+	bodyReader, err := t.newBodyReader(offset)
 	if err != nil {
 		return nil, err
 	}
 
 	newReq, err := http.NewRequest(req.Method, req.URL.String(), bodyReader)
-	newReq.Header = req.Header
+	newReq.Header = make(http.Header)
+	for k, v := range req.Header {
+		newReq.Header[k] = v
+	}
+	if offset > 0 {
+		newReq.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	}
 
 	logWithFields(logrus.Fields{
 		"count#busltee.streamer.start": 1,
 		"request_id":                   req.Header.Get("Request-Id"),
 		"url":                          req.URL,
+		"offset":                       offset,
 	}).Warn()
 	res, err := t.Transport.RoundTrip(newReq)
 	newReq.Body.Close()
@@ -100,11 +117,40 @@ func (t *Transport) runRequest(req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
-func (t *Transport) newBodyReader() (io.ReadCloser, error) {
+// committed asks the server how much of the body it already has,
+// so a retry only sends the rest. Everything is sent again when
+// that can't be told.
+func (t *Transport) committed(req *http.Request) int64 {
+	headReq, err := http.NewRequest("HEAD", req.URL.String(), nil)
+	if err != nil {
+		return 0
+	}
+	for k, v := range req.Header {
+		headReq.Header[k] = v
+	}
+
+	res, err := t.Transport.RoundTrip(headReq)
+	if err != nil {
+		return 0
+	}
+	res.Body.Close()
+
+	offset, err := strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+	if res.StatusCode != http.StatusOK || err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+func (t *Transport) newBodyReader(offset int64) (io.ReadCloser, error) {
 	reader, err := os.Open(t.bufferName)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		reader.Close()
+		return nil, err
+	}
 	return &bodyReader{reader, t, false}, nil
 }
 
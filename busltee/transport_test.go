@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -187,3 +188,46 @@ func (s *slowBuffer) Read(p []byte) (int, error) {
 	copy(p, content)
 	return len(content), io.EOF
 }
+
+func TestResume(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var received string
+	var callCount int
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(received)))
+			return
+		}
+
+		if offset := r.Header.Get("Upload-Offset"); offset != "" && offset != strconv.Itoa(len(received)) {
+			t.Fatalf("Unexpected offset %s, received %d bytes", offset, len(received))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received += string(body)
+
+		callCount += 1
+		if callCount < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	transport := &Transport{
+		MaxRetries:    5,
+		SleepDuration: time.Millisecond,
+		Resume:        true,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "", bytes.NewBufferString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("was expecting 200 got %d", res.StatusCode)
+	}
+	if received != "hello world" {
+		t.Fatalf("Expected the body to be sent once, got %q", received)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/server"
 	"github.com/heroku/rollbar"
 )
@@ -22,6 +23,7 @@ var nonWordCharacters = regexp.MustCompile(`\W`)
 type cmdConfig struct {
 	RollbarEnvironment string
 	RollbarToken       string
+	Redis              broker.RedisOptions
 
 	HTTPPort         string
 	HTTPReadTimeout  time.Duration
@@ -47,6 +49,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	httpConf.Broker, err = broker.NewRedisBroker(&cmdConf.Redis)
+	if err != nil {
+		log.Printf("%s: invalid redis configuration: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
 	s := server.NewServer(httpConf)
 	s.ReadTimeout = cmdConf.HTTPReadTimeout
 	s.WriteTimeout = cmdConf.HTTPWriteTimeout
@@ -56,10 +64,26 @@ func main() {
 func parseFlags() (*cmdConfig, *server.Config, error) {
 	httpConf := &server.Config{}
 	cmdConf := &cmdConfig{}
+	var sentinels string
 
 	cmdConf.RollbarEnvironment = os.Getenv("ROLLBAR_ENVIRONMENT")
 	cmdConf.RollbarToken = os.Getenv("ROLLBAR_TOKEN")
 
+	flag.StringVar(&cmdConf.Redis.URL, "redisUrl", os.Getenv("REDIS_URL"), "URL of the redis server")
+	flag.IntVar(&cmdConf.Redis.MaxIdle, "redisMaxIdle", 0, "Maximum number of idle redis connections, 0 for the max_idle of the URL or 3")
+	flag.DurationVar(&cmdConf.Redis.KeyExpire, "redisKeyExpire", broker.DefaultKeyExpire, "How long a stream is kept in redis after being closed")
+	flag.DurationVar(&cmdConf.Redis.ChannelExpire, "redisChannelExpire", broker.DefaultChannelExpire, "How long an idle stream is kept in redis")
+	cmdConf.Redis.KeyPrefix = os.Getenv("REDIS_KEY_PREFIX")
+	flag.StringVar(&sentinels, "redisSentinels", os.Getenv("REDIS_SENTINELS"), "Comma separated redis sentinel addresses, enables master discovery")
+	flag.StringVar(&cmdConf.Redis.SentinelMaster, "redisSentinelMaster", os.Getenv("REDIS_SENTINEL_MASTER"), "Name of the master monitored by the redis sentinels")
+	cmdConf.Redis.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	flag.BoolVar(&cmdConf.Redis.Cluster, "redisCluster", os.Getenv("REDIS_CLUSTER") == "1", "Route streams across the nodes of a redis cluster")
+	flag.IntVar(&cmdConf.Redis.CacheSize, "redisCacheSize", 0, "Memory used to cache the tail of followed streams, in bytes, negative to disable, 0 for the cache_size of the URL or the default")
+	flag.IntVar(&cmdConf.Redis.PublishLimit, "redisPublishLimit", 0, "Writes up to this many bytes are carried by their notification, 0 to disable, requires the cache")
+	flag.IntVar(&cmdConf.Redis.MaxSize, "maxStreamSize", 0, "Default size limit of streams in bytes, 0 for none")
+	flag.StringVar((*string)(&cmdConf.Redis.Layout), "redisLayout", "", "Storage layout of new streams: string, stream or segment, segment by default with compression and string otherwise")
+	flag.BoolVar(&cmdConf.Redis.Compress, "redisCompress", false, "Store the segments of new streams gzipped, requires the segment layout")
+
 	cmdConf.HTTPPort = os.Getenv("PORT")
 	flag.DurationVar(&cmdConf.HTTPReadTimeout, "httpReadTimeout", time.Hour, "Timeout for HTTP request reading")
 	flag.DurationVar(&cmdConf.HTTPWriteTimeout, "httpWriteTimeout", time.Hour, "Timeout for HTTP request writing")
@@ -68,9 +92,17 @@ func parseFlags() (*cmdConfig, *server.Config, error) {
 	httpConf.EnforceHTTPS = os.Getenv("ENFORCE_HTTPS") == "1"
 	flag.DurationVar(&httpConf.HeartbeatDuration, "subscribeHeartbeatDuration", time.Second*10, "Heartbeat interval for HTTP stream subscriptions.")
 	httpConf.StorageBaseURL = getStorageBaseURL
+	flag.DurationVar(&httpConf.MaxIdleTTL, "maxIdleTTL", 24*time.Hour, "Longest idle retention a stream may ask for when created")
+	flag.DurationVar(&httpConf.MaxClosedTTL, "maxClosedTTL", 24*time.Hour, "Longest retention after being closed a stream may ask for when created")
+	flag.DurationVar(&httpConf.PurgeGracePeriod, "purgeGracePeriod", 24*time.Hour, "How long the key of a purged stream can't be registered again")
+	flag.DurationVar(&httpConf.LeaseTTL, "publisherLeaseTTL", broker.DefaultLeaseTTL, "How long a publisher lease lasts unless renewed while publishing")
 
 	flag.Parse()
 
+	if sentinels != "" {
+		cmdConf.Redis.SentinelAddrs = strings.Split(sentinels, ",")
+	}
+
 	return cmdConf, httpConf, nil
 }
 
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"net/http"
 	"os"
 	"testing"
 
+	"github.com/heroku/busl/broker"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,3 +21,31 @@ func TestGetStorageBaseURL(t *testing.T) {
 	assert.Equal(t, "default",
 		getStorageBaseURL(&http.Request{}))
 }
+
+func TestRedisURLOptions(t *testing.T) {
+	args, redisURL := os.Args, os.Getenv("REDIS_URL")
+	defer func() {
+		os.Args = args
+		os.Setenv("REDIS_URL", redisURL)
+	}()
+
+	parse := func(url string, args ...string) broker.RedisOptions {
+		os.Args = append([]string{"busl"}, args...)
+		os.Setenv("REDIS_URL", url)
+		flag.CommandLine = flag.NewFlagSet("busl", flag.ContinueOnError)
+
+		cmdConf, _, err := parseFlags()
+		assert.Nil(t, err)
+		b, err := broker.NewRedisBroker(&cmdConf.Redis)
+		assert.Nil(t, err)
+		return b.Options()
+	}
+
+	assert.Equal(t, 3, parse("redis://127.0.0.1:6379").MaxIdle)
+	assert.Equal(t, 7, parse("redis://127.0.0.1:6379?max_idle=7").MaxIdle)
+	assert.Equal(t, 5, parse("redis://127.0.0.1:6379?max_idle=7", "-redisMaxIdle=5").MaxIdle)
+
+	assert.Equal(t, broker.DefaultCacheSize, parse("redis://127.0.0.1:6379").CacheSize)
+	assert.Equal(t, 1024, parse("redis://127.0.0.1:6379?cache_size=1024").CacheSize)
+	assert.Equal(t, -1, parse("redis://127.0.0.1:6379?cache_size=1024", "-redisCacheSize=-1").CacheSize)
+}
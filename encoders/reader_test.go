@@ -17,3 +17,24 @@ type limitedReadCloser struct {
 func (r *limitedReadCloser) Close() error {
 	return nil
 }
+
+// chunkReadCloser returns a chunk at a time.
+type chunkReadCloser struct {
+	chunks []string
+}
+
+func (r *chunkReadCloser) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func (r *chunkReadCloser) Close() error {
+	return nil
+}
@@ -8,13 +8,17 @@ import (
 )
 
 const (
-	id   = "id: %d\n"
-	data = "data: %s\n"
+	id           = "id: %d\n"
+	generationID = "id: %d:%d\n"
+	data         = "data: %s\n"
 )
 
 type sseEncoder struct {
 	io.ReadCloser       // stores the original reader
 	offset        int64 // offset for Seek purposes
+	lines         bool  // whether events end at line boundaries
+	generation    int64 // prefixes ids once the stream was reset
+	pending       []byte
 }
 
 // NewSSEEncoder creates a new server-sent event encoder
@@ -22,6 +26,23 @@ func NewSSEEncoder(r io.ReadCloser) Encoder {
 	return &sseEncoder{ReadCloser: r}
 }
 
+// NewLineSSEEncoder creates a server-sent event encoder holding back
+// partial lines, so event ids are the offsets lines start at. Lines
+// longer than the read buffer are split anyway.
+func NewLineSSEEncoder(r io.ReadCloser) Encoder {
+	return &sseEncoder{ReadCloser: r, lines: true}
+}
+
+// WithGeneration prefixes the event ids of a server-sent event
+// encoder with the stream generation when it's past the first,
+// as in `id: 2:100`, so offsets resumed from tell generations apart.
+func WithGeneration(e Encoder, generation int64) Encoder {
+	if r, ok := e.(*sseEncoder); ok && generation > 1 {
+		r.generation = generation
+	}
+	return e
+}
+
 func (r *sseEncoder) Seek(offset int64, whence int) (n int64, err error) {
 	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
 		r.offset, err = seeker.Seek(offset, whence)
@@ -42,10 +63,26 @@ func (r *sseEncoder) Seek(offset int64, whence int) (n int64, err error) {
 func (r *sseEncoder) Read(p []byte) (n int, err error) {
 	// We assume SSE won't add more than twice the amount of data we get
 	q := make([]byte, len(p)/2)
-	n, err = r.ReadCloser.Read(q)
+	n = copy(q, r.pending)
+	r.pending = r.pending[n:]
+
+	for n < len(q) {
+		var m int
+		m, err = r.ReadCloser.Read(q[n:])
+		n += m
+
+		if !r.lines || err != nil {
+			break
+		}
+		if i := bytes.LastIndexByte(q[:n], '\n'); i >= 0 {
+			r.pending = append(r.pending, q[i+1:n]...)
+			n = i + 1
+			break
+		}
+	}
 
 	if n > 0 {
-		buf := format(r.offset, q[:n])
+		buf := format(r.generation, r.offset, q[:n])
 		if len(buf) > len(p) {
 			return 0, errors.New("buffer length cannot be higher than bytes array")
 		}
@@ -57,8 +94,11 @@ func (r *sseEncoder) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-func format(pos int64, msg []byte) []byte {
+func format(generation, pos int64, msg []byte) []byte {
 	buf := bytes.NewBufferString(fmt.Sprintf(id, pos+int64(len(msg))))
+	if generation > 1 {
+		buf = bytes.NewBufferString(fmt.Sprintf(generationID, generation, pos+int64(len(msg))))
+	}
 
 	for _, line := range bytes.Split(msg, []byte{'\n'}) {
 		buf.WriteString(fmt.Sprintf(data, line))
@@ -55,6 +55,28 @@ func TestSSENonSeekableReader(t *testing.T) {
 	assert.Equal(t, "id: 11\ndata: d\n\n", readstring(enc))
 }
 
+func TestLineSSE(t *testing.T) {
+	r := &chunkReadCloser{chunks: []string{"hel", "lo\nwo", "rld\n", "tail"}}
+	enc := NewLineSSEEncoder(r)
+
+	// Ids are the offsets lines start at, but for the last one
+	assert.Equal(t, "id: 6\ndata: hello\ndata: \n\n"+
+		"id: 12\ndata: world\ndata: \n\n"+
+		"id: 16\ndata: tail\n\n", readstring(enc))
+}
+
+func TestSSEGeneration(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("hello world")}
+	enc := WithGeneration(NewSSEEncoder(r), 2)
+	enc.Seek(6, io.SeekStart)
+	assert.Equal(t, "id: 2:11\ndata: world\n\n", readstring(enc))
+
+	// The first generation keeps plain offsets
+	r = &readSeekerCloser{strings.NewReader("hello")}
+	enc = WithGeneration(NewSSEEncoder(r), 1)
+	assert.Equal(t, "id: 5\ndata: hello\n\n", readstring(enc))
+}
+
 func readstring(r io.Reader) string {
 	buf, _ := ioutil.ReadAll(r)
 	return string(buf)
@@ -2,49 +2,265 @@ package server
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
 )
 
 func (s *Server) createStream(w http.ResponseWriter, r *http.Request) {
-	registrar := broker.NewRedisRegistrar()
+	opts, err := s.channelOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if err := registrar.Register(key(r)); err != nil {
+	if err := s.Broker.RegisterWithOptions(key(r), opts); err == broker.ErrPurged || err == broker.ErrExists {
+		handleError(w, r, err)
+		return
+	} else if err != nil {
 		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
 		util.CountWithData("put.create.fail", 1, "error=%s", err)
 		handleError(w, r, err)
 		return
 	}
 	util.Count("put.create.success")
+	if meta, err := s.Broker.Meta(key(r)); err == nil {
+		w.Header().Set("X-Stream-Generation", strconv.FormatInt(meta.Generation, 10))
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// channelOptions reads the stream settings from its creation request.
+// The Content-Type header and the user creating the stream are kept
+// as metadata. In the query, idle_ttl applies while the stream is open
+// and closed_ttl once it's closed, both durations such as 24h or
+// numbers of seconds. max_size overrides the default size limit.
+// Existing streams are only wiped with reset=true, unless the request
+// is conditioned by If-None-Match: *. Legacy publishers writing after
+// closing the stream need it created with reopenable=true.
+func (s *Server) channelOptions(r *http.Request) (*broker.ChannelOptions, error) {
+	opts := &broker.ChannelOptions{
+		ContentType: r.Header.Get("Content-Type"),
+		Reset:       r.URL.Query().Get("reset") == "true" && r.Header.Get("If-None-Match") != "*",
+		Reopenable:  r.URL.Query().Get("reopenable") == "true",
+	}
+	opts.Creator, _, _ = r.BasicAuth()
+
+	var err error
+	query := r.URL.Query()
+	if opts.ChannelExpire, err = parseTTL(query.Get("idle_ttl"), s.MaxIdleTTL); err != nil {
+		return nil, fmt.Errorf("Invalid idle_ttl: %v", err)
+	}
+	if opts.KeyExpire, err = parseTTL(query.Get("closed_ttl"), s.MaxClosedTTL); err != nil {
+		return nil, fmt.Errorf("Invalid closed_ttl: %v", err)
+	}
+
+	if v := query.Get("max_size"); v != "" {
+		if opts.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || opts.MaxSize <= 0 {
+			return nil, fmt.Errorf("Invalid max_size: %s", v)
+		}
+	}
+	return opts, nil
+}
+
+func parseTTL(value string, max time.Duration) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.Atoi(value)
+		if serr != nil {
+			return 0, err
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	if ttl < time.Second {
+		return 0, fmt.Errorf("%s is shorter than a second", value)
+	}
+	if max > 0 && ttl > max {
+		return 0, fmt.Errorf("%s exceeds the maximum of %s", value, max)
+	}
+	return ttl, nil
+}
+
+func (s *Server) meta(w http.ResponseWriter, r *http.Request) {
+	meta, err := s.Broker.Meta(key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// head describes a stream through headers, without opening it.
+// Upload-Offset tells resuming publishers where to start from, and
+// Upload-Length is set once the stream is closed.
+func (s *Server) head(w http.ResponseWriter, r *http.Request) {
+	meta, err := s.Broker.Meta(key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(meta.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if meta.Closed {
+		w.Header().Set("Upload-Length", strconv.FormatInt(meta.Size, 10))
+	}
+	w.Header().Set("X-Stream-Open", strconv.FormatBool(!meta.Closed))
+	w.Header().Set("X-Stream-Generation", strconv.FormatInt(meta.Generation, 10))
+	if meta.Truncated {
+		w.Header().Set("X-Stream-Truncated", "true")
+	}
+	if meta.Sealed {
+		w.Header().Set("X-Stream-Sealed", "true")
+	}
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	if meta.UpdatedAt != nil {
+		w.Header().Set("Last-Modified", meta.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxListCount bounds the number of streams listed at once.
+const maxListCount = 1000
+
+// listStreams lists the registered streams, for operators. They can
+// be filtered by key prefix, state (open or closed) and age through
+// older_than and newer_than durations. Listing continues from the
+// cursor returned by the previous page until it's empty.
+func (s *Server) listStreams(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := &broker.ListOptions{
+		Prefix: query.Get("prefix"),
+		Cursor: query.Get("cursor"),
+	}
+
+	var err error
+	switch state := query.Get("state"); state {
+	case "":
+	case "open", "closed":
+		closed := state == "closed"
+		opts.Closed = &closed
+	default:
+		http.Error(w, "Invalid state: "+state, http.StatusBadRequest)
+		return
+	}
+	if v := query.Get("older_than"); v != "" {
+		if opts.OlderThan, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "Invalid older_than: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("newer_than"); v != "" {
+		if opts.NewerThan, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "Invalid newer_than: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("count"); v != "" {
+		if opts.Count, err = strconv.Atoi(v); err != nil || opts.Count <= 0 || opts.Count > maxListCount {
+			http.Error(w, "Invalid count: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	streams, cursor, err := s.Broker.List(opts)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if streams == nil {
+		streams = []broker.ChannelInfo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Streams []broker.ChannelInfo `json:"streams"`
+		Cursor  string               `json:"cursor"`
+	}{streams, cursor})
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
+// sealed responds with ErrClosed when the stream is sealed and
+// closed, as sealed streams are final once closed.
+func (s *Server) sealed(w http.ResponseWriter, r *http.Request, metric string) bool {
+	meta, err := s.Broker.Meta(key(r))
+	if err != nil || !meta.Sealed || !meta.Closed {
+		return false
+	}
+
+	util.CountWithData(metric, 1, "request_id=%q", r.Header.Get("Request-Id"))
+	handleError(w, r, broker.ErrClosed)
+	return true
+}
+
 func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
-	writer, err := broker.NewWriter(key(r))
+	writer, err := s.Broker.NewWriter(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
+	if s.sealed(w, r, "server.pub.sealed") {
+		return
+	}
+
 	body := bufio.NewReader(r.Body)
 	defer r.Body.Close()
 
-	wl, err := broker.Len(writer)
+	o, err := uploadOffset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wl, err := s.Broker.Len(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
-	if wl > 0 {
+
+	// Resuming publishers only send what's missing. Those sending the
+	// whole content again get what was already received skipped.
+	if o >= 0 && o != wl {
+		util.CountWithData("server.pub.offset.mismatch", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		w.Header().Set("Upload-Offset", strconv.FormatInt(wl, 10))
+		http.Error(w, "Upload offset doesn't match the stream length.", http.StatusConflict)
+		return
+	}
+
+	// Publishers presenting a lease token get exclusive access to
+	// the stream, others are only turned down while it's held. It's
+	// only taken once the request is known to be valid.
+	token := r.Header.Get("X-Lease-Token")
+	if err := s.Broker.Lease(key(r), token, s.leaseTTL()); err != nil {
+		util.CountWithData("server.pub.leased", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		handleError(w, r, err)
+		return
+	}
+	if o < 0 && wl > 0 {
 		_, err = body.Discard(int(wl))
 		if err != nil {
 			handleError(w, r, err)
@@ -52,7 +268,31 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var lease *leaseWriter
+	if token != "" {
+		lease = newLeaseWriter(writer, s.Broker, key(r), token, s.leaseTTL())
+		writer = lease
+	}
+
 	_, err = io.Copy(writer, body)
+	if lease != nil {
+		// Publishers cut off keep their lease to resume.
+		lease.Release(err == nil || err == broker.ErrTooLarge)
+	}
+
+	if err == broker.ErrTooLarge {
+		// The broker closed the truncated stream.
+		util.CountWithData("server.pub.read.toolarge", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		handleError(w, r, err)
+		go s.storeOutput(key(r), requestURI(r), indexURI(r), s.StorageBaseURL(r))
+		return
+	}
+
+	if err == broker.ErrNotRegistered || err == broker.ErrLeased || err == broker.ErrClosed {
+		// Purged, expired, taken over or closed while publishing.
+		handleError(w, r, err)
+		return
+	}
 
 	if err == io.ErrUnexpectedEOF {
 		util.CountWithData("server.pub.read.eoferror", 1, "msg=%q request_id=%q", err, r.Header.Get("Request-Id"))
@@ -77,7 +317,7 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 	util.CountWithData("server.pub.read.end", 1, "request_id=%q", r.Header.Get("Request-Id"))
 	writer.Close()
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL(r))
+	go s.storeOutput(key(r), requestURI(r), indexURI(r), s.StorageBaseURL(r))
 }
 
 func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +334,9 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, err)
 		return
 	}
+	if w.Header().Get("Content-Range") != "" {
+		w.WriteHeader(http.StatusPartialContent)
+	}
 	_, err = io.Copy(newWriteFlusher(w), rd)
 
 	netErr, ok := err.(net.Error)
@@ -109,7 +352,7 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) closeStream(w http.ResponseWriter, r *http.Request) {
-	writer, err := broker.NewWriter(key(r))
+	writer, err := s.Broker.NewWriter(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
@@ -121,6 +364,37 @@ func (s *Server) closeStream(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, err)
 		return
 	}
+	if isTus(r) {
+		w.WriteHeader(http.StatusNoContent)
+	}
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL(r))
+	go s.storeOutput(key(r), requestURI(r), indexURI(r), s.StorageBaseURL(r))
+}
+
+func (s *Server) leaseTTL() time.Duration {
+	if s.LeaseTTL > 0 {
+		return s.LeaseTTL
+	}
+	return broker.DefaultLeaseTTL
+}
+
+// purgeStream deletes the stream data from the broker and the storage
+// backend, disconnecting its subscribers. Unlike closing the stream,
+// nothing is archived, and the key can't be reused for a while.
+func (s *Server) purgeStream(w http.ResponseWriter, r *http.Request) {
+	if err := s.Broker.Purge(key(r), s.PurgeGracePeriod); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	util.CountWithData("server.purge", 1, "request_id=%q", r.Header.Get("Request-Id"))
+
+	err := storage.Delete(storageURI(r, "purge", indexQuery), s.StorageBaseURL(r))
+	if err == nil {
+		err = storage.Delete(indexURI(r), s.StorageBaseURL(r))
+	}
+	if err != nil && err != storage.ErrNoStorage {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
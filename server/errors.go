@@ -11,6 +11,11 @@ import (
 )
 
 var errNoContent = errors.New("No Content")
+var errGeneration = errors.New("Stream generation changed.")
+var errSince = errors.New("Invalid since time.")
+var errEventID = errors.New("Invalid Last-Event-ID.")
+var errNoIndex = errors.New("Stream index not found.")
+var errIndex = errors.New("Stream index unavailable.")
 
 const asciiGone = `░░░░░░░░░░██░░░░░░░░░░██░░░░░░░░
 ░░░░░░░░██░░██░░░░░░██░░██░░░░░░
@@ -39,9 +44,33 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 
 		http.Error(w, message, http.StatusNotFound)
 
+	case broker.ErrPurged, broker.ErrClosed:
+		http.Error(w, err.Error(), http.StatusGone)
+
+	case broker.ErrExists, broker.ErrLeased:
+		http.Error(w, err.Error(), http.StatusConflict)
+
+	case errNoIndex:
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+	case errIndex:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+	case errGeneration:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+
+	case broker.ErrInvalidCursor, errSince, errEventID, errLines, errTail:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+	case broker.ErrTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+
 	case storage.ErrRange:
 		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 
+	case errRange:
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+
 	case errNoContent:
 		// As indicated in the w3 spec[1] an SSE stream
 		// that's already done should return a `204 No Content`
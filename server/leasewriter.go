@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// leaseWriter holds the publisher lease of a stream while its
+// publisher is connected, renewing it even when nothing is being
+// written. Writes fail with broker.ErrLeased once the lease was lost.
+type leaseWriter struct {
+	io.WriteCloser
+	broker broker.Broker
+	key    string
+	token  string
+	ttl    time.Duration
+
+	mutex *sync.Mutex
+	err   error
+	stop  chan struct{}
+}
+
+func newLeaseWriter(w io.WriteCloser, b broker.Broker, key, token string, ttl time.Duration) *leaseWriter {
+	lw := &leaseWriter{
+		WriteCloser: w,
+		broker:      b,
+		key:         key,
+		token:       token,
+		ttl:         ttl,
+		mutex:       &sync.Mutex{},
+		stop:        make(chan struct{}),
+	}
+	go lw.renew()
+	return lw
+}
+
+func (w *leaseWriter) renew() {
+	ticker := time.NewTicker(w.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := w.broker.Lease(w.key, w.token, w.ttl)
+		if err == nil {
+			continue
+		}
+
+		util.CountWithData("server.pub.lease.error", 1, "err=%s", err)
+		if err == broker.ErrLeased {
+			w.mutex.Lock()
+			w.err = err
+			w.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (w *leaseWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	err := w.err
+	w.mutex.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return w.WriteCloser.Write(p)
+}
+
+// Release stops renewing the lease. The publisher gives it up when
+// done, otherwise it's kept until it expires so it can be reclaimed.
+func (w *leaseWriter) Release(done bool) {
+	close(w.stop)
+	if done {
+		w.broker.ReleaseLease(w.key, w.token)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errLines = errors.New("Invalid line range.")
+
+// lineRange returns the lines asked for, numbered from 1, given by
+// either of:
+//
+//   ?from_line=100
+//   ?lines=100-200
+//
+// A last line of 0 means up to the end of the stream, and a first
+// line of 0 that no line was asked for. It's ignored when resuming
+// from a Last-Event-ID.
+func lineRange(r *http.Request) (first, last int64, err error) {
+	query := r.URL.Query()
+	if r.Header.Get("last-event-id") != "" {
+		return 0, 0, nil
+	}
+
+	if v := query.Get("from_line"); v != "" {
+		if first, err = strconv.ParseInt(v, 10, 64); err != nil || first < 1 {
+			return 0, 0, errLines
+		}
+		return first, 0, nil
+	}
+
+	v := query.Get("lines")
+	if v == "" {
+		return 0, 0, nil
+	}
+	bounds := strings.SplitN(v, "-", 2)
+	if first, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || first < 1 || len(bounds) != 2 {
+		return 0, 0, errLines
+	}
+	if bounds[1] == "" {
+		return first, 0, nil
+	}
+	if last, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || last < first {
+		return 0, 0, errLines
+	}
+	return first, last, nil
+}
+
+// skipLines reads past n lines of rd, which is at offset. It returns
+// a reader of the rest and the offset it starts at.
+func skipLines(rd io.ReadCloser, offset, n int64) (io.ReadCloser, int64, error) {
+	buf := make([]byte, 32*1024)
+	for n > 0 {
+		k, err := rd.Read(buf)
+		data := buf[:k]
+		for n > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			data, n = data[i+1:], n-1
+		}
+		offset += int64(k - len(data))
+
+		if n == 0 {
+			rest := io.MultiReader(bytes.NewReader(append([]byte{}, data...)), rd)
+			return &readCloser{rest, rd}, offset, nil
+		}
+		offset += int64(len(data))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rd, offset, err
+		}
+	}
+	return rd, offset, nil
+}
+
+// readLines skips rd, which is at offset o past the marked line, to
+// the first line asked for, and stops it after the last one.
+func readLines(w http.ResponseWriter, rd io.ReadCloser, o int64, a *address, marked int64) (io.ReadCloser, int64, error) {
+	if a.first == 0 {
+		return rd, o, nil
+	}
+
+	w.Header().Set("X-Stream-Line", strconv.FormatInt(a.first, 10))
+	rd, o, err := skipLines(rd, o, a.first-marked)
+	if err != nil {
+		return rd, o, err
+	}
+	if a.last > 0 {
+		rd = &lineLimitReader{rd, a.last - a.first + 1}
+	}
+	return rd, o, nil
+}
+
+// lineLimitReader stops reading after n lines.
+type lineLimitReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *lineLimitReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+
+	k, err := r.ReadCloser.Read(p)
+	for i := 0; i < k; i++ {
+		if p[i] != '\n' {
+			continue
+		}
+		if r.n--; r.n == 0 {
+			return i + 1, io.EOF
+		}
+	}
+	return k, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -2,12 +2,14 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/heroku/authenticater"
@@ -69,32 +71,74 @@ func (s *Server) addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 		}
 		w.Header().Set("Request-ID", requestID)
 
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
-		w.Header().Set("Access-Control-Expose-Headers", "Cache-Control, Content-Type, Expires, Last-Modified")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, HEAD, PATCH")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, "+
+			"Upload-Offset, Tus-Resumable, X-Lease-Token")
+		w.Header().Set("Access-Control-Expose-Headers", "Cache-Control, Content-Type, Expires, Last-Modified, "+
+			"Upload-Offset, Upload-Length, Tus-Resumable, Tus-Version, Tus-Extension, X-Stream-Open, X-Stream-Line, "+
+			"Accept-Ranges, Content-Range")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		fn(w, r)
 	}
 }
 
-func offset(r *http.Request) (int64, error) {
-	var off string
-
-	if off = r.Header.Get("last-event-id"); off == "" {
-		if val := r.Header.Get("Range"); val != "" {
-			d := strings.SplitN(val, "=", 2)
-			if d[0] != "bytes" && len(d) == 2 {
-				return 0, errors.New("HTTP 416: Invalid Range")
+// offset returns the offset to read from, given by either of:
+//
+//   Last-Event-ID: 100
+//   Last-Event-ID: 2:100
+//   Range: bytes=100-
+//
+// Last-Event-ID takes precedence, so reconnecting SSE clients resume
+// where they stopped. Its generation is returned along, event ids
+// without one coming from the first; it's 0 for ranges.
+func offset(r *http.Request) (o, generation int64, err error) {
+	if id := r.Header.Get("last-event-id"); id != "" {
+		generation = 1
+		if parts := strings.SplitN(id, ":", 2); len(parts) == 2 {
+			if generation, err = strconv.ParseInt(parts[0], 10, 64); err != nil || generation < 1 {
+				return 0, 0, errEventID
 			}
-			tuple := strings.SplitN(d[1], "-", 2)
-			off = tuple[0]
+			id = parts[1]
+		}
+		if o, err = strconv.ParseInt(id, 10, 64); err != nil || o < 0 {
+			return 0, 0, errEventID
 		}
+		return o, generation, nil
+	}
+
+	rng, err := parseRange(r)
+	if err != nil || rng == nil {
+		return 0, 0, err
+	}
+	return rng.start, 0, nil
+}
+
+var errUploadOffset = errors.New("Invalid upload offset")
+
+// uploadOffset returns the offset the body of a publish request
+// starts at, given by either of:
+//
+//   Upload-Offset: 100
+//   Content-Range: bytes 100-*/*
+//
+// It returns -1 when the whole stream content is being sent.
+func uploadOffset(r *http.Request) (int64, error) {
+	off := r.Header.Get("Upload-Offset")
+	if val := r.Header.Get("Content-Range"); off == "" && val != "" {
+		if !strings.HasPrefix(val, "bytes ") {
+			return 0, errUploadOffset
+		}
+		off = strings.SplitN(strings.TrimPrefix(val, "bytes "), "-", 2)[0]
 	}
 
 	if off == "" {
-		return 0, nil
+		return -1, nil
+	}
+	o, err := strconv.ParseInt(off, 10, 64)
+	if err != nil || o < 0 {
+		return 0, errUploadOffset
 	}
-	return strconv.ParseInt(off, 10, 64)
+	return o, nil
 }
 
 // Given URL:
@@ -103,6 +147,10 @@ func offset(r *http.Request) (int64, error) {
 // Returns:
 //   1/2/3?foo=bar
 func requestURI(r *http.Request) string {
+	if _, ok := r.URL.Query()[indexQuery]; ok {
+		return storageURI(r, indexQuery)
+	}
+
 	res := key(r)
 
 	if r.URL.RawQuery != "" {
@@ -116,31 +164,263 @@ func key(r *http.Request) string {
 	return mux.Vars(r)["key"]
 }
 
-// Returns a broker or blob reader.
-func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	// Get the offset from Last-Event-ID: or Range:
-	o, err := offset(r)
-	if err != nil {
+// address is where to read a stream from, as requested.
+type address struct {
+	offset     int64 // from Last-Event-ID or Range
+	generation int64 // of the Last-Event-ID, if any
+	since      time.Time
+	first      int64 // first line, resolved by lookups from tailLines
+	last       int64
+	tailBytes  int64
+	tailLines  int64
+	rng        *byteRange
+}
+
+// parseAddress reads where to start reading from the request.
+func parseAddress(r *http.Request) (a *address, err error) {
+	a = &address{rng: partialRange(r)}
+	if a.offset, a.generation, err = offset(r); err != nil {
+		return nil, err
+	}
+	if a.since, err = since(r); err != nil {
+		return nil, err
+	}
+	if a.first, a.last, err = lineRange(r); err != nil {
+		return nil, err
+	}
+	if a.tailBytes, a.tailLines, err = tail(r); err != nil {
 		return nil, err
 	}
+	return a, nil
+}
+
+// Returns a broker or blob reader, along with the offset it starts at.
+func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, int64, error) {
+	a, err := parseAddress(r)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	rd, err := broker.NewReader(key(r))
+	meta, metaErr := s.Broker.Meta(key(r))
+	if metaErr == nil {
+		if err := checkGeneration(w, r, a, meta); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	snapshot := !follow(r)
+	var rd io.ReadCloser
+	if snapshot {
+		rd, err = s.Broker.NewSnapshotReader(key(r))
+	} else {
+		rd, err = s.Broker.NewReader(key(r))
+	}
+
+	switch {
+	case err == broker.ErrNotRegistered:
+		// Not cached in the broker anymore, try the storage backend as a fallback.
+		return s.newArchivedReader(w, r, a)
+	case err != nil:
+		return rd, 0, err
+	}
+	return s.newLiveReader(w, r, rd, snapshot, a, meta, metaErr)
+}
 
-	// Not cached in the broker anymore, try the storage backend as a fallback.
-	if err == broker.ErrNotRegistered {
-		return storage.Get(requestURI(r), s.StorageBaseURL(r), o)
+// checkGeneration ensures offsets are only used within the generation
+// they come from, and tells which one is read.
+func checkGeneration(w http.ResponseWriter, r *http.Request, a *address, meta *broker.Metadata) error {
+	generation := strconv.FormatInt(meta.Generation, 10)
+	switch g := r.Header.Get("X-Stream-Generation"); {
+	case g != "" && g != generation:
+		return errGeneration
+	case a.generation > 0 && a.generation != meta.Generation:
+		return errGeneration
+	case meta.Generation > 1 && a.offset > meta.Size:
+		// Resumed from before the reset, without telling.
+		return errGeneration
+	}
+	w.Header().Set("X-Stream-Generation", generation)
+	return nil
+}
+
+// newLiveReader starts rd, a broker reader, where the request asks.
+func (s *Server) newLiveReader(w http.ResponseWriter, r *http.Request, rd io.ReadCloser, snapshot bool, a *address, meta *broker.Metadata, metaErr error) (io.ReadCloser, int64, error) {
+	// Ranges of followed streams are only bounded by their end.
+	size := int64(-1)
+	switch {
+	case snapshot:
+		size = snapshotLen(rd)
+		if metaErr == nil {
+			w.Header().Set("X-Stream-Open", strconv.FormatBool(!meta.Closed))
+		}
+		if preferMinimal(r) {
+			w.Header().Set("Preference-Applied", "return=minimal")
+		}
+	case metaErr == nil && meta.Closed:
+		size = meta.Size
+	}
+	if rng := a.rng; rng != nil && (size >= 0 || (rng.suffix == 0 && rng.end >= 0)) {
+		return liveRange(w, rd, rng, size)
+	}
+	if (a.tailBytes > 0 || a.tailLines > 0) && metaErr != nil {
+		return rd, 0, metaErr
 	}
 
+	o, marked, err := s.liveOffset(r, a, meta)
+	if err != nil {
+		return rd, 0, err
+	}
 	if o > 0 {
 		if seeker, ok := rd.(io.Seeker); ok {
 			seeker.Seek(o, 0)
 		}
 	}
-	return rd, err
+	return readLines(w, rd, o, a, marked)
+}
+
+// liveOffset resolves where to read a stream from the broker from,
+// along with the offset of the closest marked line.
+func (s *Server) liveOffset(r *http.Request, a *address, meta *broker.Metadata) (o, marked int64, err error) {
+	if a.tailLines > 0 {
+		a.first = tailLine(meta.Lines, a.tailLines)
+	}
+
+	switch {
+	case a.first > 0:
+		return s.Broker.LineOffset(key(r), a.first)
+	case a.tailBytes > 0:
+		return tailOffset(meta.Size, a.tailBytes), 0, nil
+	case !a.since.IsZero():
+		o, err = s.Broker.TimeOffset(key(r), a.since)
+		return o, 0, err
+	}
+	return a.offset, 0, nil
+}
+
+// newArchivedReader reads a stream from the storage backend.
+func (s *Server) newArchivedReader(w http.ResponseWriter, r *http.Request, a *address) (io.ReadCloser, int64, error) {
+	if a.rng != nil {
+		return s.archivedRange(w, r, a.rng)
+	}
+	if a.tailBytes > 0 {
+		return storage.GetTail(storageURI(r, queryParams...), s.StorageBaseURL(r), a.tailBytes)
+	}
+
+	o, marked, err := s.archivedOffset(r, a)
+	if err != nil {
+		return nil, 0, err
+	}
+	rd, err := storage.Get(storageURI(r, queryParams...), s.StorageBaseURL(r), o)
+	if err != nil {
+		return rd, o, err
+	}
+	return readLines(w, rd, o, a, marked)
+}
+
+// archivedOffset resolves where to read an archived stream from,
+// looking lines and times up in its index, along with the offset of
+// the closest marked line.
+func (s *Server) archivedOffset(r *http.Request, a *address) (o, marked int64, err error) {
+	if a.first == 0 && a.tailLines == 0 && a.since.IsZero() {
+		return a.offset, 0, nil
+	}
+
+	index, err := s.archivedIndex(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if a.tailLines > 0 {
+		a.first = tailLine(index.LineCount, a.tailLines)
+	}
+	if a.first > 0 {
+		o, marked = index.LineOffset(a.first)
+		return o, marked, nil
+	}
+	return index.TimeOffset(a.since), 0, nil
+}
+
+// addressParams are the query parameters addressing where to start
+// reading a stream from.
+var addressParams = []string{"since", "from_line", "lines", "tail"}
+
+// queryParams are the query parameters meant for busl when reading
+// a stream, the rest authorizing the storage requests.
+var queryParams = append([]string{"follow", indexQuery}, addressParams...)
+
+// since returns the time given by the since query parameter, either
+// RFC3339 or a duration before now, such as 10m. It's ignored when
+// resuming from a Last-Event-ID.
+func since(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("since")
+	if v == "" || r.Header.Get("last-event-id") != "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return time.Time{}, errSince
+	}
+	return time.Now().Add(-d), nil
+}
+
+// archivedIndex returns the index archived along with the stream.
+// Lookups fail without it, rather than replaying it from the start.
+func (s *Server) archivedIndex(r *http.Request) (*broker.Index, error) {
+	rd, err := storage.Get(indexURI(r), s.StorageBaseURL(r), 0)
+	if rd != nil {
+		defer rd.Close()
+	}
+	if err == storage.ErrNotFound {
+		return nil, errNoIndex
+	}
+	if err != nil {
+		util.CountWithData("server.sub.index.error", 1, "err=%s", err)
+		return nil, errIndex
+	}
+
+	index := &broker.Index{}
+	if err := json.NewDecoder(rd).Decode(index); err != nil {
+		util.CountWithData("server.sub.index.error", 1, "err=%s", err)
+		return nil, errIndex
+	}
+	return index, nil
+}
+
+// storageURI returns the request URI without the query parameters
+// meant for busl, the rest authorizing the storage requests.
+func storageURI(r *http.Request, params ...string) string {
+	query := r.URL.Query()
+	for _, p := range params {
+		query.Del(p)
+	}
+
+	uri := key(r)
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	return uri
+}
+
+// indexQuery is the query parameter authorizing the storage requests
+// of the stream index, such as presigned URLs signed for it alone.
+const indexQuery = "index_query"
+
+// indexURI returns where the index of the stream is stored, alongside
+// it, with the query given by the index_query parameter:
+//   1/2/3?sig=1&index_query=sig%3D2 => 1/2/3.index?sig=2
+func indexURI(r *http.Request) string {
+	uri := key(r) + ".index"
+	if query := r.URL.Query().Get(indexQuery); query != "" {
+		uri += "?" + query
+	}
+	return uri
 }
 
 func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	rd, err := s.newStorageReader(w, r)
+	rd, o, err := s.newStorageReader(w, r)
 	if err != nil {
 		if rd != nil {
 			rd.Close()
@@ -152,13 +432,7 @@ func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadClose
 	// the keepalive ack.
 	ack := []byte{0}
 
-	o, err := offset(r)
-	if err != nil {
-		rd.Close()
-		return nil, err
-	}
-
-	if broker.NoContent(rd, o) {
+	if s.noContent(key(r), o) {
 		rd.Close()
 		return nil, errNoContent
 	}
@@ -168,28 +442,84 @@ func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadClose
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		encoder = encoders.NewSSEEncoder(rd)
-		encoder.(io.Seeker).Seek(o, 0)
+		// Line addressed events end at line boundaries.
+		if w.Header().Get("X-Stream-Line") != "" {
+			encoder = encoders.NewLineSSEEncoder(rd)
+		} else {
+			encoder = encoders.NewSSEEncoder(rd)
+		}
+		generation, _ := strconv.ParseInt(w.Header().Get("X-Stream-Generation"), 10, 64)
+		encoder = encoders.WithGeneration(encoder, generation)
 
 		// For SSE, we change the ack to a :keepalive
 		ack = []byte(":keepalive\n")
 	} else {
+		w.Header().Set("Accept-Ranges", "bytes")
 		encoder = encoders.NewTextEncoder(rd)
+
+		// Snapshots of live streams have a definite length.
+		if n := snapshotLen(rd); n >= 0 && w.Header().Get("X-Stream-Open") != "" {
+			w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		}
 	}
 	encoder.Seek(o, io.SeekStart)
 
+	// Keepalive acks would be counted in a definite length.
+	if w.Header().Get("Content-Length") != "" {
+		return encoder, nil
+	}
+
 	done := w.(http.CloseNotifier).CloseNotify()
-	return newKeepAliveReader(encoder, ack, s.HeartbeatDuration, done), nil
+	renew := func() { s.Broker.RenewExpiry(key(r)) }
+	return newKeepAliveReader(encoder, ack, s.HeartbeatDuration, done, renew), nil
+}
+
+// Returns whether the channel is closed and has nothing
+// left to send past the given offset.
+func (s *Server) noContent(key string, offset int64) bool {
+	if done, err := s.Broker.Done(key); err != nil || !done {
+		return false
+	}
+
+	l, err := s.Broker.Len(key)
+	if err != nil {
+		return false
+	}
+	return offset > (l - 1)
 }
 
-func storeOutput(channel string, requestURI string, storageBase string) {
+func (s *Server) storeOutput(channel string, requestURI string, indexURI string, storageBase string) {
 	defer util.TimerEnd(util.TimerStart("server.storeOutput"))
 
-	if buf, err := broker.Get(channel); err == nil {
-		if err := storage.Put(requestURI, storageBase, bytes.NewBuffer(buf)); err != nil {
+	if rd, err := s.Broker.NewSnapshotReader(channel); err == nil {
+		defer rd.Close()
+		if err := storage.Put(requestURI, storageBase, rd); err != nil {
 			util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
+			return
 		}
 	} else {
 		util.CountWithData("server.storeOutput.get.error", 1, "err=%s", err.Error())
+		return
+	}
+
+	// A purge arriving mid-upload deleted the archive before it was
+	// written. Being only allowed to PUT, what was stored is blanked.
+	if registered, err := s.Broker.IsRegistered(channel); err == nil && !registered {
+		util.Count("server.storeOutput.purged")
+		if err := storage.Put(requestURI, storageBase, bytes.NewReader(nil)); err != nil {
+			util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
+		}
+		return
+	}
+
+	// The index is stored alongside, for lookups in the archive.
+	index, err := s.Broker.Index(channel)
+	if err != nil {
+		util.CountWithData("server.storeOutput.index.error", 1, "err=%s", err.Error())
+		return
+	}
+	data, _ := json.Marshal(index)
+	if err := storage.Put(indexURI, storageBase, bytes.NewReader(data)); err != nil {
+		util.CountWithData("server.storeOutput.index.error", 1, "err=%s", err.Error())
 	}
 }
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/storage"
+)
+
+var errRange = errors.New("Invalid Range")
+
+// byteRange is the single range of a Range header[1], either of:
+//
+//   bytes=100-     from offset 100 on
+//   bytes=100-199  from offset 100 to 199, included
+//   bytes=-100     the last 100 bytes
+//
+// [1]: https://tools.ietf.org/html/rfc7233#section-2.1
+type byteRange struct {
+	start, end int64 // end is -1 for open ranges
+	suffix     int64 // length of a suffix range, without start and end
+}
+
+// parseRange parses the Range header of the request. As allowed by
+// RFC 7233, ranges of other units and multiple ranges are ignored,
+// returning nil.
+func parseRange(r *http.Request) (*byteRange, error) {
+	val := r.Header.Get("Range")
+	if !strings.HasPrefix(val, "bytes=") || strings.Contains(val, ",") {
+		return nil, nil
+	}
+
+	bounds := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(val, "bytes=")), "-", 2)
+	if len(bounds) != 2 {
+		return nil, errRange
+	}
+
+	if bounds[0] == "" {
+		n, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || n < 1 {
+			return nil, errRange
+		}
+		return &byteRange{suffix: n}, nil
+	}
+
+	rng := &byteRange{end: -1}
+	var err error
+	if rng.start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || rng.start < 0 {
+		return nil, errRange
+	}
+	if bounds[1] != "" {
+		if rng.end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || rng.end < rng.start {
+			return nil, errRange
+		}
+	}
+	return rng, nil
+}
+
+// resolve returns the offsets of the range within size bytes, both
+// included, and whether it's satisfiable.
+func (rng *byteRange) resolve(size int64) (start, end int64, ok bool) {
+	if rng.suffix > 0 {
+		return tailOffset(size, rng.suffix), size - 1, size > 0
+	}
+
+	end = rng.end
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	return rng.start, end, rng.start < size
+}
+
+func (rng *byteRange) String() string {
+	switch {
+	case rng.suffix > 0:
+		return fmt.Sprintf("bytes=-%d", rng.suffix)
+	case rng.end < 0:
+		return fmt.Sprintf("bytes=%d-", rng.start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", rng.start, rng.end)
+}
+
+// setPartialContent sets the headers of a 206 response for the
+// range from start to end of size bytes, -1 when unknown.
+func setPartialContent(w http.ResponseWriter, start, end, size int64) {
+	length := "*"
+	if size >= 0 {
+		length = strconv.FormatInt(size, 10)
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, length))
+}
+
+// parseContentRange parses the Content-Range of a 206 response,
+// where size is -1 when unknown.
+func parseContentRange(val string) (start, end, size int64, ok bool) {
+	var length string
+	if n, _ := fmt.Sscanf(val, "bytes %d-%d/%s", &start, &end, &length); n != 3 {
+		return 0, 0, 0, false
+	}
+
+	size = -1
+	if length != "*" {
+		size, _ = strconv.ParseInt(length, 10, 64)
+	}
+	return start, end, size, true
+}
+
+// partialRange returns the range of requests answered with 206
+// Partial Content: plain reads, neither resumed nor addressed by
+// time, lines or tail.
+func partialRange(r *http.Request) *byteRange {
+	if r.Header.Get("last-event-id") != "" || r.Header.Get("Accept") == "text/event-stream" {
+		return nil
+	}
+
+	query := r.URL.Query()
+	for _, p := range addressParams {
+		if query.Get(p) != "" {
+			return nil
+		}
+	}
+	rng, _ := parseRange(r)
+	return rng
+}
+
+// liveRange limits the broker reader to the range, which is resolved
+// against the size of closed streams and snapshots, -1 for followed
+// streams still open, read up to the range end.
+func liveRange(w http.ResponseWriter, rd io.ReadCloser, rng *byteRange, size int64) (io.ReadCloser, int64, error) {
+	start, end := rng.start, rng.end
+	if size >= 0 {
+		var ok bool
+		if start, end, ok = rng.resolve(size); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return rd, 0, errRange
+		}
+	}
+
+	if seeker, ok := rd.(io.Seeker); ok && start > 0 {
+		seeker.Seek(start, io.SeekStart)
+	}
+	setPartialContent(w, start, end, size)
+	return &readCloser{io.LimitReader(rd, end-start+1), rd}, start, nil
+}
+
+// archivedRange gets the range from the storage backend, relaying
+// its Content-Range. Everything is returned from offset 0 by servers
+// not supporting ranges.
+func (s *Server) archivedRange(w http.ResponseWriter, r *http.Request, rng *byteRange) (io.ReadCloser, int64, error) {
+	rd, contentRange, err := storage.GetRange(storageURI(r, queryParams...), s.StorageBaseURL(r), rng.String())
+	if err == storage.ErrRange && contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+	if err != nil {
+		return rd, 0, err
+	}
+
+	start, end, size, ok := parseContentRange(contentRange)
+	if !ok {
+		return rd, 0, nil
+	}
+	setPartialContent(w, start, end, size)
+	return &readCloser{io.LimitReader(rd, end-start+1), rd}, start, nil
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/braintree/manners"
 	"github.com/gorilla/mux"
+	"github.com/heroku/busl/broker"
 )
 
 // Config holds all the server options
@@ -15,6 +16,19 @@ type Config struct {
 	Credentials       string
 	HeartbeatDuration time.Duration
 	StorageBaseURL    func(*http.Request) string
+	Broker            broker.Broker
+
+	// Upper bounds of the retention streams may ask for when
+	// created, zero meaning unbounded.
+	MaxIdleTTL   time.Duration
+	MaxClosedTTL time.Duration
+
+	// How long purged stream keys can't be reused.
+	PurgeGracePeriod time.Duration
+
+	// How long publisher leases last unless renewed, zero
+	// meaning broker.DefaultLeaseTTL.
+	LeaseTTL time.Duration
 }
 
 // Server is a launchable api listener
@@ -54,10 +68,18 @@ func (s *Server) router() http.Handler {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/health", s.addDefaultHeaders(s.health))
+	r.HandleFunc("/streams", s.auth(s.addDefaultHeaders(s.listStreams))).Methods("GET")
+
+	// Takes precedence, so stream keys can't end with /meta.
+	r.HandleFunc("/streams/{key:.+}/meta", s.addDefaultHeaders(s.meta)).Methods("GET")
 
 	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.subscribe)).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(tusResumable(s.head))).Methods("HEAD")
 	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.publish)).Methods("POST")
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.closeStream)).Methods("DELETE")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(tusResumable(s.tusPatch))).Methods("PATCH")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(tusResumable(s.tusOptions))).Methods("OPTIONS")
+	r.HandleFunc("/streams/{key:.+}", s.auth(s.addDefaultHeaders(s.purgeStream))).Methods("DELETE").Queries("purge", "true")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(tusResumable(s.closeStream))).Methods("DELETE")
 	r.HandleFunc("/streams/{key:.+}", s.auth(s.addDefaultHeaders(s.createStream))).Methods("PUT")
 
 	return logRequest(s.enforceHTTPS(r.ServeHTTP))
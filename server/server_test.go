@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -20,6 +21,7 @@ var baseServer = NewServer(&Config{
 	Credentials:       "",
 	HeartbeatDuration: time.Second,
 	StorageBaseURL:    func(*http.Request) string { return "" },
+	Broker:            broker.NewMemoryBroker(),
 })
 
 func Test410(t *testing.T) {
@@ -47,10 +49,9 @@ func TestPubNotRegistered(t *testing.T) {
 func TestPubClosed(t *testing.T) {
 	uuid, _ := util.NewUUID()
 
-	registrar := broker.NewRedisRegistrar()
-	err := registrar.Register(uuid)
+	err := baseServer.Broker.Register(uuid)
 	assert.Nil(t, err)
-	writer, err := broker.NewWriter(uuid)
+	writer, err := baseServer.Broker.NewWriter(uuid)
 	assert.Nil(t, err)
 	writer.Close()
 
@@ -63,13 +64,38 @@ func TestPubClosed(t *testing.T) {
 	assert.Equal(t, response.Code, http.StatusNotFound)
 }
 
+func TestPubSealed(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("busl"))
+	writer.Close()
+
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("busl hello"))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	data, _ := baseServer.Broker.Get(uuid)
+	assert.Equal(t, "busl", string(data))
+
+	resp, err = http.Head(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "true", resp.Header.Get("X-Stream-Sealed"))
+}
+
 func TestPubWithoutTransferEncoding(t *testing.T) {
 	client := &http.Client{Transport: &http.Transport{}}
 	server := httptest.NewServer(baseServer.router())
 	uuid, _ := util.NewUUID()
 
-	registrar := broker.NewRedisRegistrar()
-	err := registrar.Register(uuid)
+	err := baseServer.Broker.Register(uuid)
 	assert.Nil(t, err)
 
 	req, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("hello world"))
@@ -160,7 +186,7 @@ func TestPublisherReconnect(t *testing.T) {
 
 	done := make(chan bool)
 
-	writer, err := broker.NewWriter(uuid)
+	writer, err := baseServer.Broker.NewWriter(uuid)
 	assert.Nil(t, err)
 	_, err = writer.Write([]byte("hello"))
 	assert.Nil(t, err)
@@ -208,15 +234,16 @@ func TestPubSubRange(t *testing.T) {
 		offset int
 		input  string
 		output string
+		status int
 	}{
-		{0, "hello", "hello"},
-		{0, "hello\n", "hello\n"},
-		{0, "hello\nworld", "hello\nworld"},
-		{0, "hello\nworld\n", "hello\nworld\n"},
-		{1, "hello\nworld\n", "ello\nworld\n"},
-		{6, "hello\nworld\n", "world\n"},
-		{11, "hello\nworld\n", "\n"},
-		{12, "hello\nworld\n", ""},
+		{0, "hello", "hello", http.StatusPartialContent},
+		{0, "hello\n", "hello\n", http.StatusPartialContent},
+		{0, "hello\nworld", "hello\nworld", http.StatusPartialContent},
+		{0, "hello\nworld\n", "hello\nworld\n", http.StatusPartialContent},
+		{1, "hello\nworld\n", "ello\nworld\n", http.StatusPartialContent},
+		{6, "hello\nworld\n", "world\n", http.StatusPartialContent},
+		{11, "hello\nworld\n", "\n", http.StatusPartialContent},
+		{12, "hello\nworld\n", "Invalid Range\n", http.StatusRequestedRangeNotSatisfiable},
 	}
 
 	client := &http.Client{Transport: &http.Transport{}}
@@ -253,10 +280,7 @@ func TestPubSubRange(t *testing.T) {
 
 			body, _ := ioutil.ReadAll(resp.Body)
 			assert.Equal(t, body, []byte(testdata.output))
-
-			if len(body) == 0 {
-				assert.Equal(t, resp.StatusCode, http.StatusNoContent)
-			}
+			assert.Equal(t, resp.StatusCode, testdata.status)
 
 			done <- true
 		}()
@@ -338,19 +362,450 @@ func TestPut(t *testing.T) {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
-	// uuid = curl -XPUT <url>/streams/1/2/3
-	request, _ := http.NewRequest("PUT", server.URL+"/streams/1/2/3", nil)
+	// uuid = curl -XPUT <url>/streams/<uuid>/1/2/3
+	uuid, _ := util.NewUUID()
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid+"/1/2/3", nil)
 	resp, err := client.Do(request)
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, resp.StatusCode, http.StatusCreated)
 
-	registrar := broker.NewRedisRegistrar()
-	r, err := registrar.IsRegistered("1/2/3")
+	r, err := baseServer.Broker.IsRegistered(uuid + "/1/2/3")
 	assert.Nil(t, err)
 	assert.True(t, r)
 }
 
+func TestPutExisting(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	put := func(query, ifNoneMatch string) *http.Response {
+		request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid+query, nil)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := put("", "")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Stream-Generation"))
+
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("busl"))
+
+	assert.Equal(t, http.StatusConflict, put("", "").StatusCode)
+	assert.Equal(t, http.StatusConflict, put("?reset=true", "*").StatusCode)
+
+	resp = put("?reset=true", "")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Stream-Generation"))
+
+	// Subscribers resuming from the first generation are turned down.
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Range", "bytes=2-")
+	request.Header.Set("X-Stream-Generation", "1")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// So are those resuming without telling: event ids from the first
+	// generation have none, and ranges past the end are from before.
+	writer, _ = baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("b"))
+	for _, header := range [][]string{
+		{"Last-Event-ID", "2"},
+		{"Last-Event-ID", "1:1"},
+		{"Range", "bytes=4-"},
+	} {
+		request, _ = http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		request.Header.Set(header[0], header[1])
+		resp, err = http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode, header[1])
+	}
+
+	// Event ids carry the generation once reset
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte("usl"))
+		writer.Close()
+	}()
+	request, _ = http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Last-Event-ID", "2:1")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 2:4\ndata: usl\n\n", string(body))
+}
+
+func TestPutWithRetention(t *testing.T) {
+	config := *baseServer.Config
+	config.MaxIdleTTL = 24 * time.Hour
+	server := httptest.NewServer(NewServer(&config).router())
+	defer server.Close()
+
+	for query, status := range map[string]int{
+		"idle_ttl=24h&closed_ttl=300": http.StatusCreated,
+		"idle_ttl=25h":                http.StatusBadRequest,
+		"idle_ttl=0":                  http.StatusBadRequest,
+		"closed_ttl=forever":          http.StatusBadRequest,
+	} {
+		uuid, _ := util.NewUUID()
+		request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid+"?"+query, nil)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, query)
+
+		registered, _ := baseServer.Broker.IsRegistered(uuid)
+		assert.Equal(t, status == http.StatusCreated, registered, query)
+	}
+}
+
+func TestPubTooLarge(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid+"?max_size=4", nil)
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/streams/"+uuid, "", bytes.NewBufferString("busl hello"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "busl"+broker.TruncatedMarker, string(body))
+}
+
+func TestPubLeased(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	baseServer.Broker.Lease(uuid, "held", time.Minute)
+
+	for _, test := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusConflict},
+		{"other", http.StatusConflict},
+		{"held", http.StatusOK},
+	} {
+		request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("busl"))
+		request.TransferEncoding = []string{"chunked"}
+		if test.token != "" {
+			request.Header.Set("X-Lease-Token", test.token)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode, test.token)
+	}
+
+	// The lease was released once done publishing.
+	assert.Nil(t, baseServer.Broker.Lease(uuid, "", time.Minute))
+}
+
+func TestPubInvalidOffsetLease(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+
+	// Invalid requests don't take the lease
+	for header, value := range map[string]string{"Upload-Offset": "x", "Content-Range": "bytes 10-*/*"} {
+		request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("busl"))
+		request.Header.Set("X-Lease-Token", "bad")
+		request.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode, header)
+		assert.Nil(t, baseServer.Broker.Lease(uuid, "", time.Minute), header)
+	}
+}
+
+func TestPubUploadOffset(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("busl"))
+
+	post := func(header, value, body string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString(body))
+		request.TransferEncoding = []string{"chunked"}
+		request.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := post("Upload-Offset", "2", "sl hello")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+
+	resp = post("Content-Range", "bytes=4", " hello")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = post("Content-Range", "bytes 4-*/*", " hello")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data, _ := baseServer.Broker.Get(uuid)
+	assert.Equal(t, "busl hello", string(data))
+}
+
+func TestTus(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+
+	do := func(method, offset, body string) *http.Response {
+		request, _ := http.NewRequest(method, server.URL+"/streams/"+uuid, bytes.NewBufferString(body))
+		request.Header.Set("Tus-Resumable", "1.0.0")
+		request.Header.Set("Content-Type", "application/offset+octet-stream")
+		if offset != "" {
+			request.Header.Set("Upload-Offset", offset)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "1.0.0", resp.Header.Get("Tus-Resumable"))
+		return resp
+	}
+
+	resp := do("OPTIONS", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "1.0.0", resp.Header.Get("Tus-Version"))
+	assert.Equal(t, "termination", resp.Header.Get("Tus-Extension"))
+
+	resp = do("PATCH", "0", "busl")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+
+	resp = do("PATCH", "0", "busl")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+
+	resp = do("HEAD", "", "")
+	assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "", resp.Header.Get("Upload-Length"))
+
+	resp = do("PATCH", "4", " hello")
+	assert.Equal(t, "10", resp.Header.Get("Upload-Offset"))
+
+	resp = do("DELETE", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do("HEAD", "", "")
+	assert.Equal(t, "10", resp.Header.Get("Upload-Length"))
+
+	resp = do("PATCH", "10", "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	data, _ := baseServer.Broker.Get(uuid)
+	assert.Equal(t, "busl hello", string(data))
+}
+
+func TestTusErrors(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+
+	for _, test := range []struct {
+		version, contentType string
+		status               int
+	}{
+		{"0.2.0", "application/offset+octet-stream", http.StatusPreconditionFailed},
+		{"", "application/offset+octet-stream", http.StatusPreconditionFailed},
+		{"1.0.0", "text/plain", http.StatusUnsupportedMediaType},
+	} {
+		request, _ := http.NewRequest("PATCH", server.URL+"/streams/"+uuid, bytes.NewBufferString("busl"))
+		request.Header.Set("Upload-Offset", "0")
+		request.Header.Set("Content-Type", test.contentType)
+		if test.version != "" {
+			request.Header.Set("Tus-Resumable", test.version)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "/meta")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	baseServer.Broker.RegisterWithOptions(uuid, &broker.ChannelOptions{ContentType: "text/plain"})
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("busl"))
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "/meta")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var meta map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&meta))
+	assert.Equal(t, "text/plain", meta["content_type"])
+	assert.Equal(t, float64(4), meta["size"])
+	assert.Equal(t, false, meta["closed"])
+}
+
+func TestHead(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("busl"))
+
+	resp, err := http.Head(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "4", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, "true", resp.Header.Get("X-Stream-Open"))
+
+	writer.Close()
+	resp, err = http.Head(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "false", resp.Header.Get("X-Stream-Open"))
+}
+
+func TestListStreams(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	prefix, _ := util.NewUUID()
+	baseServer.Broker.Register(prefix + "/1")
+	baseServer.Broker.Register(prefix + "/2")
+	writer, _ := baseServer.Broker.NewWriter(prefix + "/2")
+	writer.Close()
+
+	resp, err := http.Get(server.URL + "/streams?state=closed&prefix=" + prefix)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var list struct {
+		Streams []broker.ChannelInfo
+		Cursor  string
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Len(t, list.Streams, 1)
+	assert.Equal(t, prefix+"/2", list.Streams[0].Key)
+	assert.Equal(t, "", list.Cursor)
+
+	for _, query := range []string{"state=gone", "count=0", "older_than=1"} {
+		resp, err := http.Get(server.URL + "/streams?" + query)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var deleted []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.Method+" "+r.URL.RequestURI())
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	baseServer.PurgeGracePeriod = time.Minute
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+		baseServer.PurgeGracePeriod = 0
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("secret"))
+
+	request, _ := http.NewRequest("DELETE", server.URL+"/streams/"+uuid+"?purge=true&sig=1&index_query=sig%3D2", nil)
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, []string{"DELETE /" + uuid + "?sig=1", "DELETE /" + uuid + ".index?sig=2"}, deleted)
+
+	registered, _ := baseServer.Broker.IsRegistered(uuid)
+	assert.False(t, registered)
+
+	request, _ = http.NewRequest("PUT", server.URL+"/streams/"+uuid, nil)
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestPurgeDuringUpload(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("secret"))
+	writer.Close()
+
+	var puts []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		puts = append(puts, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		if len(puts) == 1 {
+			baseServer.Broker.Purge(uuid, 0)
+		}
+	}))
+	defer storage.Close()
+
+	// The archive written after the purge deleted it is blanked
+	baseServer.storeOutput(uuid, uuid+"?sig=1", uuid+".index?sig=2", storage.URL)
+	assert.Equal(t, []string{"PUT /" + uuid + "?sig=1 secret", "PUT /" + uuid + "?sig=1 "}, puts)
+}
+
 func TestSubGoneWithBackend(t *testing.T) {
 	uuid, _ := util.NewUUID()
 
@@ -376,6 +831,481 @@ func TestSubGoneWithBackend(t *testing.T) {
 	assert.Equal(t, body, []byte("hello world"))
 }
 
+func TestSubSince(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("busl hello"))
+	writer.Close()
+
+	url := server.URL + "/streams/" + uuid + "?since="
+	resp, err := http.Get(url + time.Now().Add(-time.Hour).Format(time.RFC3339))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "busl hello", string(body))
+
+	resp, err = http.Get(url + "1h")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "busl hello", string(body))
+
+	// Nothing was written since then
+	resp, err = http.Get(url + time.Now().Add(time.Hour).Format(time.RFC3339))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	for _, since := range []string{"yesterday", "-1h"} {
+		resp, err = http.Get(url + since)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, since)
+	}
+}
+
+func TestSubLines(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	for i := 1; i <= 2500; i++ {
+		fmt.Fprintf(writer, "line %d\n", i)
+	}
+
+	// Bounded ranges end while the stream is still open
+	for _, lines := range [][]string{
+		{"1-2", "line 1\nline 2\n"},
+		{"999-1002", "line 999\nline 1000\nline 1001\nline 1002\n"},
+	} {
+		resp, err := http.Get(server.URL + "/streams/" + uuid + "?lines=" + lines[0])
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, lines[1], string(body), lines[0])
+	}
+	writer.Close()
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?from_line=2499")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "line 2499\nline 2500\n", string(body))
+	assert.Equal(t, "2499", resp.Header.Get("X-Stream-Line"))
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?lines=2500-2600")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "line 2500\n", string(body))
+
+	// SSE ids are the offsets of the lines
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?from_line=2500", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	l, _ := baseServer.Broker.Len(uuid)
+	assert.Equal(t, fmt.Sprintf("id: %d\ndata: line 2500\ndata: \n\n", l), string(body))
+
+	for _, query := range []string{"from_line=0", "lines=3-2", "lines=a-b", "lines=3"} {
+		resp, err = http.Get(server.URL + "/streams/" + uuid + "?" + query)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/streams/1/2/3?lines=3-4&tail=lines:2", nil)
+	a, err := parseAddress(r)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(3), a.first)
+	assert.Equal(t, int64(4), a.last)
+	assert.Equal(t, int64(2), a.tailLines)
+	assert.Nil(t, a.rng)
+
+	r, _ = http.NewRequest("GET", "/streams/1/2/3?lines=3", nil)
+	_, err = parseAddress(r)
+	assert.Equal(t, errLines, err)
+}
+
+func TestReadLines(t *testing.T) {
+	data := "line 1\nline 2\nline 3\nline 4\n"
+
+	// The reader starts at the marked line 2
+	w := httptest.NewRecorder()
+	rd := ioutil.NopCloser(bytes.NewBufferString(data[7:]))
+	rd, o, err := readLines(w, rd, 7, &address{first: 3, last: 3}, 2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(rd)
+	assert.Equal(t, "line 3\n", string(body))
+	assert.Equal(t, int64(14), o)
+	assert.Equal(t, "3", w.Header().Get("X-Stream-Line"))
+
+	// Without lines, the reader is left as is
+	w = httptest.NewRecorder()
+	rd = ioutil.NopCloser(bytes.NewBufferString(data))
+	rd, o, err = readLines(w, rd, 0, &address{}, 0)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(rd)
+	assert.Equal(t, data, string(body))
+	assert.Equal(t, int64(0), o)
+	assert.Equal(t, "", w.Header().Get("X-Stream-Line"))
+}
+
+func TestSubTail(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(writer, "line %d\n", i)
+	}
+
+	// The stream is followed once its tail was sent
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(writer, "line 11\n")
+		writer.Close()
+	}()
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?tail=lines:2")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "line 9\nline 10\nline 11\n", string(body))
+	assert.Equal(t, "9", resp.Header.Get("X-Stream-Line"))
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Range", "bytes=-8")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "line 11\n", string(body))
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?tail=bytes:1000")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Len(t, body, 79)
+
+	for _, tail := range []string{"lines", "lines:0", "pages:1", "bytes:x"} {
+		resp, err = http.Get(server.URL + "/streams/" + uuid + "?tail=" + tail)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, tail)
+	}
+}
+
+func TestSubTailRange(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("hello world"))
+
+	// Suffix ranges of open streams tail them
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		writer.Write([]byte("!"))
+		writer.Close()
+	}()
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Range", "bytes=-5")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "world!", string(body))
+}
+
+func TestSubTailWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	index, _ := json.Marshal(&broker.Index{Size: 17, LineCount: 2})
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + uuid + ".index":
+			w.Write(index)
+		case "/" + uuid:
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("busl hello\nworld\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Range", "bytes=-6")
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 17\ndata: world\ndata: \n\n", string(body))
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?tail=lines:1")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "world\n", string(body))
+}
+
+func TestSubSnapshot(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("hello world"))
+
+	// Snapshots end without waiting for the stream to close
+	client := &http.Client{Timeout: time.Second}
+	get := func(url string, header ...string) (*http.Response, string) {
+		request, _ := http.NewRequest("GET", url, nil)
+		for i := 0; i < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := get(server.URL + "/streams/" + uuid + "?follow=false")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, int64(11), resp.ContentLength)
+	assert.Equal(t, "true", resp.Header.Get("X-Stream-Open"))
+
+	resp, body = get(server.URL+"/streams/"+uuid, "Prefer", "respond-async, return=minimal")
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "return=minimal", resp.Header.Get("Preference-Applied"))
+
+	resp, body = get(server.URL+"/streams/"+uuid+"?follow=false", "Range", "bytes=6-")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 6-10/11", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "world", body)
+
+	_, body = get(server.URL+"/streams/"+uuid+"?follow=false", "Accept", "text/event-stream")
+	assert.Equal(t, "id: 11\ndata: hello world\n\n", body)
+
+	resp, body = get(server.URL + "/streams/" + uuid + "?follow=false&tail=bytes:5")
+	assert.Equal(t, "world", body)
+	assert.Equal(t, int64(5), resp.ContentLength)
+
+	writer.Close()
+	resp, body = get(server.URL + "/streams/" + uuid + "?follow=false")
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "false", resp.Header.Get("X-Stream-Open"))
+}
+
+func TestParseRange(t *testing.T) {
+	data := []struct {
+		header string
+		rng    *byteRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=100-", &byteRange{start: 100, end: -1}, nil},
+		{"bytes=100-199", &byteRange{start: 100, end: 199}, nil},
+		{"bytes=-100", &byteRange{suffix: 100}, nil},
+		{"bytes=0-0,-1", nil, nil},
+		{"lines=1-2", nil, nil},
+		{"bytes=x-", nil, errRange},
+		{"bytes=100", nil, errRange},
+		{"bytes=199-100", nil, errRange},
+		{"bytes=-0", nil, errRange},
+		{"bytes=-", nil, errRange},
+	}
+
+	for _, testdata := range data {
+		r, _ := http.NewRequest("GET", "/streams/1/2/3", nil)
+		r.Header.Set("Range", testdata.header)
+		rng, err := parseRange(r)
+		assert.Equal(t, testdata.rng, rng, testdata.header)
+		assert.Equal(t, testdata.err, err, testdata.header)
+	}
+}
+
+func TestSubRange(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid)
+	writer, _ := baseServer.Broker.NewWriter(uuid)
+	writer.Write([]byte("hello world"))
+
+	get := func(byteRange string) (*http.Response, string) {
+		request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		request.Header.Set("Range", byteRange)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	// Bounded ranges of open streams end without waiting for it to close
+	resp, body := get("bytes=6-8")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 6-8/*", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "wor", body)
+
+	writer.Close()
+
+	data := []struct {
+		header       string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=6-", http.StatusPartialContent, "bytes 6-10/11", "world"},
+		{"bytes=0-4", http.StatusPartialContent, "bytes 0-4/11", "hello"},
+		{"bytes=6-100", http.StatusPartialContent, "bytes 6-10/11", "world"},
+		{"bytes=-5", http.StatusPartialContent, "bytes 6-10/11", "world"},
+		{"bytes=-100", http.StatusPartialContent, "bytes 0-10/11", "hello world"},
+		{"bytes=11-", http.StatusRequestedRangeNotSatisfiable, "bytes */11", "Invalid Range\n"},
+		{"bytes=x-1", http.StatusRequestedRangeNotSatisfiable, "", "Invalid Range\n"},
+		{"bytes=0-0,6-6", http.StatusOK, "", "hello world"},
+	}
+
+	for _, testdata := range data {
+		resp, body := get(testdata.header)
+		assert.Equal(t, testdata.status, resp.StatusCode, testdata.header)
+		assert.Equal(t, testdata.contentRange, resp.Header.Get("Content-Range"), testdata.header)
+		assert.Equal(t, testdata.body, body, testdata.header)
+		if testdata.status == http.StatusPartialContent {
+			assert.Equal(t, int64(len(body)), resp.ContentLength, testdata.header)
+		}
+	}
+}
+
+func TestSubRangeWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("busl hello\nworld\n")))
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	data := []struct {
+		header       string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=5-9", http.StatusPartialContent, "bytes 5-9/17", "hello"},
+		{"bytes=11-", http.StatusPartialContent, "bytes 11-16/17", "world\n"},
+		{"bytes=-6", http.StatusPartialContent, "bytes 11-16/17", "world\n"},
+		{"bytes=17-", http.StatusRequestedRangeNotSatisfiable, "bytes */17", ""},
+	}
+
+	for _, testdata := range data {
+		request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		request.Header.Set("Range", testdata.header)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, testdata.status, resp.StatusCode, testdata.header)
+		assert.Equal(t, testdata.contentRange, resp.Header.Get("Content-Range"), testdata.header)
+		assert.Equal(t, testdata.body, string(body), testdata.header)
+	}
+}
+
+func TestSubIndexWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	start := time.Date(2016, 1, 1, 14, 0, 0, 0, time.UTC)
+	index, _ := json.Marshal(&broker.Index{
+		Size: 11,
+		Times: []broker.TimeMark{
+			{Time: start, Offset: 0},
+			{Time: start.Add(time.Minute), Offset: 6},
+		},
+		Lines: []broker.LineMark{{Line: 3, Offset: 6}},
+	})
+
+	var ranges []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.RequestURI() {
+		case "/" + uuid + ".index?sig=2":
+			w.Write(index)
+		case "/" + uuid + "?sig=1":
+			ranges = append(ranges, r.Header.Get("Range"))
+			w.Write([]byte("world\nagain\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?sig=1&index_query=sig%3D2&since=2016-01-01T14:00:30Z")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "world\nagain\n", string(body))
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?sig=1&index_query=sig%3D2&from_line=4")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "again\n", string(body))
+	assert.Equal(t, []string{"bytes=6-", "bytes=6-"}, ranges)
+
+	// Lookups fail without the index, rather than replaying everything
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?sig=1&from_line=4")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, []string{"bytes=6-", "bytes=6-"}, ranges)
+}
+
 func TestPutWithBackend(t *testing.T) {
 	uuid, _ := util.NewUUID()
 
@@ -393,8 +1323,7 @@ func TestPutWithBackend(t *testing.T) {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
-	registrar := broker.NewRedisRegistrar()
-	registrar.Register(uuid)
+	baseServer.Broker.Register(uuid)
 
 	// uuid = curl -XPUT <url>/streams/1/2/3
 	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewReader([]byte("hello world")))
@@ -406,6 +1335,35 @@ func TestPutWithBackend(t *testing.T) {
 	assert.Equal(t, <-put, []byte("hello world"))
 }
 
+func TestPubWithSignedBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	puts := make(chan string, 2)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		puts <- r.Method + " " + r.URL.RequestURI()
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	baseServer.Broker.Register(uuid)
+
+	// The index is stored with its own signature
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid+"?sig=1&index_query=sig%3D2", bytes.NewReader([]byte("hello")))
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "PUT /"+uuid+"?sig=1", <-puts)
+	assert.Equal(t, "PUT /"+uuid+".index?sig=2", <-puts)
+}
+
 func TestAuthentication(t *testing.T) {
 	baseServer.Credentials = "u:pass1|u:pass2"
 	defer func() {
@@ -419,11 +1377,15 @@ func TestAuthentication(t *testing.T) {
 	client := &http.Client{Transport: transport}
 
 	testdata := map[string]string{
-		"PUT": "/streams/1/2/3",
+		"PUT":    "/streams/1/2/3?reset=true",
+		"GET":    "/streams",
+		"DELETE": "/streams/1/2/3?purge=true",
 	}
 
 	status := map[string]int{
-		"PUT": http.StatusCreated,
+		"PUT":    http.StatusCreated,
+		"GET":    http.StatusOK,
+		"DELETE": http.StatusNoContent,
 	}
 
 	// Validate that we return 401 for empty and invalid tokens
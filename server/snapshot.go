@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// follow returns whether the stream is followed until it's closed.
+// Subscribers only wanting what it holds now ask for a snapshot with
+// either of:
+//
+//   ?follow=false
+//   Prefer: return=minimal
+func follow(r *http.Request) bool {
+	return r.URL.Query().Get("follow") != "false" && !preferMinimal(r)
+}
+
+// preferMinimal returns whether the request has the return=minimal
+// preference[1].
+//
+// [1]: https://tools.ietf.org/html/rfc7240#section-4.2
+func preferMinimal(r *http.Request) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, pref := range strings.Split(header, ",") {
+			pref = strings.TrimSpace(strings.SplitN(pref, ";", 2)[0])
+			if strings.EqualFold(strings.Replace(pref, " ", "", -1), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// snapshotLen returns the number of bytes left to read from a broker
+// snapshot, or -1 when it's unknown.
+func snapshotLen(rd interface{}) int64 {
+	if l, ok := rd.(interface {
+		Len() int
+	}); ok {
+		return int64(l.Len())
+	}
+	return -1
+}
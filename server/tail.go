@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errTail = errors.New("Invalid tail.")
+
+// tail returns how much of the end of the stream is asked for, as a
+// number of bytes or lines, given by either of:
+//
+//   ?tail=lines:200
+//   ?tail=bytes:4096
+//   Range: bytes=-4096
+//
+// The stream is then followed as usual. It's ignored when resuming
+// from a Last-Event-ID.
+func tail(r *http.Request) (bytes, lines int64, err error) {
+	if r.Header.Get("last-event-id") != "" {
+		return 0, 0, nil
+	}
+
+	v := r.URL.Query().Get("tail")
+	if v == "" {
+		if rng, _ := parseRange(r); rng != nil && rng.suffix > 0 {
+			return rng.suffix, 0, nil
+		}
+		return 0, 0, nil
+	}
+
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, errTail
+	}
+	n, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || n < 1 {
+		return 0, 0, errTail
+	}
+
+	switch parts[0] {
+	case "bytes":
+		return n, 0, nil
+	case "lines":
+		return 0, n, nil
+	}
+	return 0, 0, errTail
+}
+
+// tailLine returns the first of the last n lines of a stream with
+// count newlines, the line being written coming along.
+func tailLine(count, n int64) int64 {
+	if count < n {
+		return 1
+	}
+	return count - n + 1
+}
+
+// tailOffset returns the offset of the last n bytes of size.
+func tailOffset(size, n int64) int64 {
+	if size < n {
+		return 0
+	}
+	return size - n
+}
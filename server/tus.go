@@ -0,0 +1,119 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// Streams can be published to with the core tus protocol[1] and its
+// termination extension, for clients which can't keep a request open:
+//
+//   OPTIONS  discovers the protocol version and extensions
+//   HEAD     returns the Upload-Offset to send from
+//   PATCH    appends its body from Upload-Offset
+//   DELETE   closes the stream
+//
+// [1]: https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "termination"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusResumable sets the protocol version of the responses, rejecting
+// the requests of clients speaking another version.
+func tusResumable(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		v := r.Header.Get("Tus-Resumable")
+		if v != "" && v != tusVersion && r.Method != "OPTIONS" {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func isTus(r *http.Request) bool {
+	return r.Header.Get("Tus-Resumable") != ""
+}
+
+func (s *Server) tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusPatch appends the request body to the stream, which is kept open.
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request) {
+	if !isTus(r) {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	o, err := uploadOffset(r)
+	if err != nil || o < 0 {
+		http.Error(w, errUploadOffset.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer, err := s.Broker.NewWriter(key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if s.sealed(w, r, "server.tus.sealed") {
+		return
+	}
+
+	wl, err := s.Broker.Len(key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if o != wl {
+		util.CountWithData("server.tus.offset.mismatch", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		w.Header().Set("Upload-Offset", strconv.FormatInt(wl, 10))
+		http.Error(w, "Upload offset doesn't match the stream length.", http.StatusConflict)
+		return
+	}
+
+	if err := s.Broker.Lease(key(r), r.Header.Get("X-Lease-Token"), s.leaseTTL()); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	n, err := io.Copy(writer, r.Body)
+	if err == broker.ErrTooLarge {
+		handleError(w, r, err)
+		go s.storeOutput(key(r), requestURI(r), indexURI(r), s.StorageBaseURL(r))
+		return
+	}
+	if err == io.ErrUnexpectedEOF {
+		// What was received is kept, clients resume from HEAD.
+		util.CountWithData("server.tus.read.eoferror", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	util.CountWithData("server.tus.patch", 1, "request_id=%q bytes=%d", r.Header.Get("Request-Id"), n)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(wl+n, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
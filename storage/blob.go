@@ -25,7 +25,9 @@ var (
 // with the given requestURI. The requestURI is resolved
 // using the `STORAGE_BASE_URL` as the base.
 //
-// Retries transient errors `retries` number of times.
+// Retries transient errors `retries` number of times, sending the
+// data again from where the reader started. Readers which can't seek
+// back aren't retried, as the data they sent is gone.
 //
 // Usage:
 //
@@ -34,7 +36,24 @@ var (
 //   err := storage.Put(requestURI, reader)
 //
 func Put(requestURI, baseURI string, reader io.Reader) (err error) {
+	seeker, seekable := reader.(io.Seeker)
+	var start int64
+	if seekable {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
 	for i := retries; i > 0; i-- {
+		if i < retries {
+			if !seekable {
+				break
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				util.Count("storage.put.error")
+				return err
+			}
+		}
 		err = put(requestURI, baseURI, reader)
 
 		// Break if we get nil / any error other than Err5xx
@@ -62,6 +81,14 @@ func put(requestURI, baseURI string, reader io.Reader) error {
 	if err != nil {
 		return err
 	}
+
+	// Readers streaming their content, such as broker snapshots,
+	// may still know its length.
+	if l, ok := reader.(interface {
+		Len() int
+	}); ok && req.ContentLength == 0 && l.Len() > 0 {
+		req.ContentLength = int64(l.Len())
+	}
 	res, err := process(req)
 	if res != nil {
 		defer res.Body.Close()
@@ -79,18 +106,48 @@ func put(requestURI, baseURI string, reader io.Reader) error {
 //   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
 //   reader, err := storage.Get(requestURI, 0)
 //
-func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error) {
+func Get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+	var byteRange string
+	if offset > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-", offset)
+	}
+
+	rd, _, err := getRange(requestURI, baseURI, byteRange)
+	return rd, err
+}
+
+// GetTail grabs the last n bytes stored in requestURI, along with
+// the offset they start at. Everything is returned from offset 0 by
+// servers not supporting ranges.
+//
+// Retries transient errors `retries` number of times.
+func GetTail(requestURI, baseURI string, n int64) (io.ReadCloser, int64, error) {
+	rd, contentRange, err := getRange(requestURI, baseURI, fmt.Sprintf("bytes=-%d", n))
+	return rd, rangeStart(contentRange), err
+}
+
+// GetRange grabs the byteRange, such as `bytes=100-199`, of the data
+// stored in requestURI, along with the Content-Range returned, which
+// is empty when everything is returned by servers not supporting
+// ranges. The Content-Range of ErrRange gives the stored length.
+//
+// Retries transient errors `retries` number of times.
+func GetRange(requestURI, baseURI, byteRange string) (io.ReadCloser, string, error) {
+	return getRange(requestURI, baseURI, byteRange)
+}
+
+func getRange(requestURI, baseURI, byteRange string) (rd io.ReadCloser, contentRange string, err error) {
 	for i := retries; i > 0; i-- {
-		rd, err = get(requestURI, baseURI, offset)
+		rd, contentRange, err = get(requestURI, baseURI, byteRange)
 
 		if err == nil {
 			util.Count("storage.get.success")
-			return rd, nil
+			return rd, contentRange, nil
 		}
 
 		if err != Err5xx {
 			util.Count("storage.get.error")
-			return rd, err
+			return rd, contentRange, err
 		}
 
 		// Close the body immediately to prevent
@@ -104,26 +161,74 @@ func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error)
 
 	// We've ran out of retries
 	util.Count("storage.get.maxretries")
-	return rd, err
+	return rd, contentRange, err
 }
 
-func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+func get(requestURI, baseURI, byteRange string) (io.ReadCloser, string, error) {
 	req, err := newRequest("GET", requestURI, baseURI, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	req.TransferEncoding = []string{"chunked"}
 	req.Header.Add("Transfer-Encoding", "chunked")
 
-	if offset > 0 {
-		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	if byteRange != "" {
+		req.Header.Add("Range", byteRange)
 	}
 
 	res, err := process(req)
 	if res == nil {
-		return nil, err
+		return nil, "", err
 	}
-	return res.Body, err
+	return res.Body, res.Header.Get("Content-Range"), err
+}
+
+// rangeStart returns the offset a Content-Range starts at:
+//   bytes 100-199/1000 => 100
+func rangeStart(contentRange string) int64 {
+	var start int64
+	fmt.Sscanf(contentRange, "bytes %d-", &start)
+	return start
+}
+
+// Delete removes the data stored in requestURI, which is
+// considered done if there is nothing stored there already.
+// The requestURI is resolved using the `STORAGE_BASE_URL` as the base.
+//
+// Retries transient errors `retries` number of times.
+func Delete(requestURI, baseURI string) (err error) {
+	for i := retries; i > 0; i-- {
+		err = del(requestURI, baseURI)
+
+		if err == nil || err == ErrNotFound {
+			util.Count("storage.delete.success")
+			return nil
+		}
+
+		if err != Err5xx {
+			util.Count("storage.delete.error")
+			return err
+		}
+
+		util.Count("storage.delete.retry")
+	}
+
+	// We've ran out of retries
+	util.Count("storage.delete.maxretries")
+	return err
+}
+
+func del(requestURI, baseURI string) error {
+	req, err := newRequest("DELETE", requestURI, baseURI, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := process(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	return err
 }
 
 // constructs an http.Request object, resolving requestURI
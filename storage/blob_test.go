@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -108,3 +111,109 @@ func TestGetIllegalOffset(t *testing.T) {
 		t.Fatalf("%v != Expected 200, got 416", err)
 	}
 }
+
+// lenReader hides the concrete reader type from net/http,
+// only exposing its length.
+type lenReader struct {
+	r *strings.Reader
+}
+
+func (l lenReader) Read(p []byte) (int, error) { return l.r.Read(p) }
+func (l lenReader) Len() int                   { return l.r.Len() }
+
+func TestPutContentLength(t *testing.T) {
+	var length int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length = r.ContentLength
+	}))
+	defer server.Close()
+
+	err := Put("1/2/3", server.URL, lenReader{strings.NewReader("busl")})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), length)
+}
+
+// seekReader hides its type from http.NewRequest, as broker
+// snapshots do.
+type seekReader struct {
+	*strings.Reader
+}
+
+func TestPutRetry(t *testing.T) {
+	var attempts int
+	var stored string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := ioutil.ReadAll(r.Body)
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		stored = string(body)
+	}))
+	defer server.Close()
+
+	err := Put("1/2/3", server.URL, seekReader{strings.NewReader("busl")})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, "busl", stored)
+}
+
+func TestDelete(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "DELETE", r.Method)
+		deleted = append(deleted, r.URL.RequestURI())
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	assert.Nil(t, Delete("1/2/3?sig=1", server.URL))
+	assert.Nil(t, Delete("missing", server.URL))
+	assert.Equal(t, []string{"/1/2/3?sig=1", "/missing"}, deleted)
+	assert.Equal(t, ErrNoStorage, Delete("1/2/3", ""))
+}
+
+func TestGetTail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("busl hello world"))
+	}))
+	defer server.Close()
+
+	rd, offset, err := GetTail("1/2/3", server.URL, 5)
+	assert.Nil(t, err)
+	defer rd.Close()
+	data, _ := ioutil.ReadAll(rd)
+	assert.Equal(t, "world", string(data))
+	assert.Equal(t, int64(11), offset)
+
+	// The whole content is shorter
+	rd, offset, err = GetTail("1/2/3", server.URL, 100)
+	assert.Nil(t, err)
+	defer rd.Close()
+	data, _ = ioutil.ReadAll(rd)
+	assert.Equal(t, "busl hello world", string(data))
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestGetRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("busl hello world"))
+	}))
+	defer server.Close()
+
+	rd, contentRange, err := GetRange("1/2/3", server.URL, "bytes=5-9")
+	assert.Nil(t, err)
+	defer rd.Close()
+	data, _ := ioutil.ReadAll(rd)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, "bytes 5-9/16", contentRange)
+
+	// The stored length is given with unsatisfiable ranges
+	rd, contentRange, err = GetRange("1/2/3", server.URL, "bytes=16-")
+	assert.Equal(t, ErrRange, err)
+	defer rd.Close()
+	assert.Equal(t, "bytes */16", contentRange)
+}